@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+// maxAdminRequestSize limits the JSON body of admin requests
+const maxAdminRequestSize = 64 << 10
+
+// checkAdmin verifies the request's bearer token against ADMIN_TOKEN and writes an error
+// response if it does not match. Admin endpoints are disabled while ADMIN_TOKEN is unset.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := config.GetEnvWithDefault("ADMIN_TOKEN", "")
+	if token == "" {
+		sendErrorResponse(w, http.StatusForbidden, fmt.Errorf("ADMIN_TOKEN is not set"), "Admin endpoints are disabled")
+		return false
+	}
+
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		sendErrorResponse(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid admin token"), "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// extendRequest is the JSON body of POST /admin/expirations/{id}/extend.
+// Either extendBy is added to the current expiry, or expiresAt replaces it.
+type extendRequest struct {
+	ExtendBy  string    `json:"extendBy"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AdminExpirationsHandler serves GET /admin/expirations, GET /admin/expirations/{id}
+// and POST /admin/expirations/{id}/extend
+func AdminExpirationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !checkAdmin(w, r) {
+		return
+	}
+
+	store, err := getExpiryStore()
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Expiry store unavailable")
+		return
+	}
+
+	id := strings.TrimSpace(r.PathValue("id"))
+	extend := strings.HasSuffix(r.URL.Path, "/extend")
+
+	switch {
+	case extend && r.Method == "POST":
+		extendExpiration(w, r, store, id)
+
+	case !extend && r.Method == "GET" && id != "":
+		expiration, ok := store.Get(id)
+		if !ok {
+			sendErrorResponse(w, http.StatusNotFound, fmt.Errorf("expiration %s not found", id), "Expiration not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   expiration,
+		})
+
+	case !extend && r.Method == "GET":
+		remote := r.URL.Query().Get("remote")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   store.List(remote),
+		})
+
+	default:
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+	}
+}
+
+// extendExpiration moves an expiration later, by extendBy or to expiresAt
+func extendExpiration(w http.ResponseWriter, r *http.Request, store *ExpiryStore, id string) {
+	var req extendRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminRequestSize)).Decode(&req); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err), "Invalid request")
+		return
+	}
+
+	current, ok := store.Get(id)
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, fmt.Errorf("expiration %s not found", id), "Expiration not found")
+		return
+	}
+
+	var expiresAt time.Time
+	switch {
+	case req.ExtendBy != "" && !req.ExpiresAt.IsZero():
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("extendBy and expiresAt are exclusive"), "Invalid request")
+		return
+	case req.ExtendBy != "":
+		d, err := parseExpiresIn(req.ExtendBy)
+		if err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+			return
+		}
+		// An overdue expiration is extended from now
+		base := current.ExpiresAt
+		if now := time.Now(); base.Before(now) {
+			base = now
+		}
+		expiresAt = base.Add(d)
+	case !req.ExpiresAt.IsZero():
+		if !req.ExpiresAt.After(current.ExpiresAt) {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("expiresAt must be after the current expiry %s", current.ExpiresAt.Format(time.RFC3339)), "Invalid request")
+			return
+		}
+		expiresAt = req.ExpiresAt
+	default:
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("extendBy or expiresAt is required"), "Invalid request")
+		return
+	}
+
+	if !expiresAt.After(time.Now()) || time.Until(expiresAt) > maxExpiresIn {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("expiresAt must be in the future and within 365 days"), "Invalid request")
+		return
+	}
+
+	expiration, err := store.Extend(id, expiresAt)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to extend expiration")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   expiration,
+	})
+}
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// defaultMaxArchiveSize caps the total size of the files in an archive
+	defaultMaxArchiveSize = 10 << 30
+	// archiveURLMaxAge is how long download URLs from a listing are used before being
+	// fetched again; OneDrive's expire after about an hour
+	archiveURLMaxAge = 30 * time.Minute
+)
+
+// errArchiveTooLarge is returned for folders holding more than an archive may
+var errArchiveTooLarge = errors.New("archive too large")
+
+// MaxArchiveSize returns the largest total size of the files GET /archive packs
+func MaxArchiveSize() int64 {
+	return config.GetEnvSizeWithDefault("ARCHIVE_MAX_SIZE", defaultMaxArchiveSize)
+}
+
+// compressedExtensions are stored in zip archives as they are, as deflating them gains nothing
+var compressedExtensions = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".xz": true, ".bz2": true, ".zst": true, ".7z": true, ".rar": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".webm": true, ".avi": true, ".mov": true,
+	".apk": true, ".jar": true, ".iso": true, ".img": true,
+}
+
+// archiveEntry is a file packed into an archive
+type archiveEntry struct {
+	Name string // path within the archive
+	Item azure.DriveItem
+}
+
+// archiveFilter selects the files of an archive by glob. A pattern without a slash matches
+// file names, one with a slash the path within the archive.
+type archiveFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// parseGlobs reads the patterns of a repeatable, comma separated query parameter
+func parseGlobs(values []string) ([]string, error) {
+	var globs []string
+	for _, value := range values {
+		for _, glob := range strings.Split(value, ",") {
+			if glob = strings.Trim(strings.TrimSpace(glob), "/"); glob == "" {
+				continue
+			}
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+			}
+			globs = append(globs, glob)
+		}
+	}
+	return globs, nil
+}
+
+// matchGlob reports whether name, a path within the archive, matches any of globs
+func matchGlob(globs []string, name string) bool {
+	for _, glob := range globs {
+		target := name
+		if !strings.Contains(glob, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(glob, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the file at name goes into the archive
+func (f *archiveFilter) match(name string) bool {
+	if len(f.Include) > 0 && !matchGlob(f.Include, name) {
+		return false
+	}
+	return !matchGlob(f.Exclude, name)
+}
+
+// collectArchiveEntries walks the folder at relPath and everything below it, collecting the
+// files that pass filter. prefix is relPath's path within the archive and budget caps the
+// number of items listed.
+func collectArchiveEntries(ctx context.Context, client *azure.AzureClient, remote, relPath, prefix string, filter *archiveFilter, budget *int, entries *[]archiveEntry) error {
+	items, truncated, err := listAll(ctx, client, remote, relPath, budget)
+	if err != nil {
+		return err
+	}
+	if truncated {
+		return fmt.Errorf("%w: folder has more than %d items", errArchiveTooLarge, MaxListItems())
+	}
+
+	sortItems(items, &listOptions{Sort: "name"})
+	for _, item := range items {
+		name := path.Join(prefix, item.Name)
+		if item.Folder != nil {
+			if err := collectArchiveEntries(ctx, client, remote, filepath.Join(relPath, item.Name), name, filter, budget, entries); err != nil {
+				return err
+			}
+			continue
+		}
+		if item.File != nil && filter.match(name) {
+			*entries = append(*entries, archiveEntry{Name: name, Item: item})
+		}
+	}
+	return nil
+}
+
+// archiveWriter writes entries into one archive format
+type archiveWriter interface {
+	// Create starts an entry; its content is written to the returned writer
+	Create(entry *archiveEntry) (io.Writer, error)
+	// Close writes the end of the archive
+	Close() error
+}
+
+// zipArchive writes a zip archive
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+// Create starts a zip entry, deflating files that are not compressed already
+func (a *zipArchive) Create(entry *archiveEntry) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Deflate,
+		Modified: entry.Item.LastModifiedDateTime,
+	}
+	if compressedExtensions[strings.ToLower(path.Ext(entry.Name))] {
+		header.Method = zip.Store
+	}
+	header.SetMode(0644)
+	return a.zw.CreateHeader(header)
+}
+
+// Close writes the zip's central directory
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+// tarGzArchive writes a gzip compressed tar archive
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+// Create writes a tar header; the entry's size must be known up front
+func (a *tarGzArchive) Create(entry *archiveEntry) (io.Writer, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry.Name,
+		Size:     entry.Item.Size,
+		Mode:     0644,
+		ModTime:  entry.Item.LastModifiedDateTime,
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return a.tw, nil
+}
+
+// Close ends the tar stream and flushes the gzip stream
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// writeArchiveEntry streams one file's content into the archive, verifying it against
+// OneDrive's QuickXorHash on the way
+func writeArchiveEntry(ctx context.Context, client *azure.AzureClient, archive archiveWriter, entry *archiveEntry, listedAt time.Time) error {
+	downloadURL := entry.Item.DownloadURL
+	if downloadURL == "" || time.Since(listedAt) > archiveURLMaxAge {
+		item, err := client.GetItem(ctx, http.DefaultClient, entry.Item.ID)
+		if err != nil {
+			return err
+		}
+		if item.Size != entry.Item.Size {
+			return fmt.Errorf("file changed while archiving")
+		}
+		downloadURL = item.DownloadURL
+	}
+
+	body, err := client.OpenDownload(ctx, http.DefaultClient, downloadURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w, err := archive.Create(entry)
+	if err != nil {
+		return err
+	}
+	hasher := azure.NewQuickXorHash()
+	n, err := io.Copy(io.MultiWriter(w, hasher), io.LimitReader(body, entry.Item.Size))
+	if err != nil {
+		return err
+	}
+	if n != entry.Item.Size {
+		return fmt.Errorf("download ended %d bytes early: %w", entry.Item.Size-n, io.ErrUnexpectedEOF)
+	}
+
+	expected := entry.Item.File.Hashes.QuickXorHash
+	if hash := azure.EncodeQuickXorHash(hasher.Sum(nil)); expected != "" && hash != expected {
+		return fmt.Errorf("%w: downloaded %s, OneDrive has %s", errHashMismatch, hash, expected)
+	}
+	return nil
+}
+
+// ArchiveHandler handles GET /archive/{remote}/{path}, which streams every file in a folder
+// and its subfolders as one zip or tar.gz archive, built on the fly
+func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	remote := r.PathValue("remote")
+	if _, ok := rootFolders[remote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+	relPath := cleanRemotePath(r.PathValue("path"))
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "zip"
+	case "zip", "tar.gz":
+	default:
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid format: %s (must be zip or tar.gz)", format), "Invalid request")
+		return
+	}
+
+	var filter archiveFilter
+	var err error
+	if filter.Include, err = parseGlobs(query["include"]); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+	if filter.Exclude, err = parseGlobs(query["exclude"]); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+
+	client, err := openRemote(r.Context(), remote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	folder, err := client.GetItemByPath(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to fetch folder")
+		return
+	}
+	if folder.Folder == nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("%s is not a folder", relPath), "Invalid request")
+		return
+	}
+
+	// Everything is listed before the first byte is sent, so limits can still be reported
+	listedAt := time.Now()
+	budget := MaxListItems()
+	var entries []archiveEntry
+	if err := collectArchiveEntries(r.Context(), client, remote, relPath, "", &filter, &budget, &entries); err != nil {
+		if errors.Is(err, errArchiveTooLarge) {
+			sendErrorResponse(w, http.StatusRequestEntityTooLarge, err, "Archive too large")
+			return
+		}
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to list folder")
+		return
+	}
+	if len(entries) == 0 {
+		sendErrorResponse(w, http.StatusNotFound, fmt.Errorf("no files to archive in %s", relPath), "Nothing to archive")
+		return
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Item.Size
+	}
+	if maxSize := MaxArchiveSize(); total > maxSize {
+		sendErrorResponse(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%w: %d bytes in %d files, limit is %d", errArchiveTooLarge, total, len(entries), maxSize), "Archive too large")
+		return
+	}
+
+	// Large archives take longer to stream than the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Unable to clear write deadline for archive: %v", err)
+	}
+
+	name := folder.Name
+	if relPath == "" {
+		name = remote
+	}
+	var archive archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{zw: zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	w.WriteHeader(http.StatusOK)
+
+	log.Printf("Archiving %d files (%d bytes) of %s on %s as %s", len(entries), total, relPath, remote, format)
+	for i := range entries {
+		if err := writeArchiveEntry(r.Context(), client, archive, &entries[i], listedAt); err != nil {
+			// The status is sent already; dropping the connection keeps a client from taking
+			// the truncated archive for a complete one
+			log.Printf("Archiving %s failed at %s: %v", relPath, entries[i].Name, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Finishing archive of %s failed: %v", relPath, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("Archived %d files of %s on %s", len(entries), relPath, remote)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Supported checksum algorithms, in the order they are reported
+var checksumAlgorithms = []string{"sha256", "sha1", "md5"}
+
+// errChecksumMismatch is returned when a client supplied checksum does not match the received data
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumSet computes all supported digests of the data written to it
+type checksumSet struct {
+	hashes map[string]hash.Hash
+}
+
+// newChecksumSet returns a checksumSet for all supported algorithms
+func newChecksumSet() *checksumSet {
+	return &checksumSet{
+		hashes: map[string]hash.Hash{
+			"sha256": sha256.New(),
+			"sha1":   sha1.New(),
+			"md5":    md5.New(),
+		},
+	}
+}
+
+// Write feeds p to every digest
+func (c *checksumSet) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Digests returns the hex encoded digest for each algorithm
+func (c *checksumSet) Digests() map[string]string {
+	digests := make(map[string]string, len(c.hashes))
+	for name, h := range c.hashes {
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests
+}
+
+// parseExpectedChecksums decodes client supplied checksums keyed by algorithm.
+// Values may be hex or base64 encoded; empty values are ignored.
+func parseExpectedChecksums(values map[string]string) (map[string]string, error) {
+	expected := make(map[string]string)
+	for _, name := range checksumAlgorithms {
+		value := strings.TrimSpace(values[name])
+		if value == "" {
+			continue
+		}
+
+		size := newChecksumSet().hashes[name].Size()
+		if raw, err := hex.DecodeString(value); err == nil && len(raw) == size {
+			expected[name] = hex.EncodeToString(raw)
+			continue
+		}
+		if raw, err := base64.StdEncoding.DecodeString(value); err == nil && len(raw) == size {
+			expected[name] = hex.EncodeToString(raw)
+			continue
+		}
+		return nil, fmt.Errorf("invalid %s checksum: %s", name, value)
+	}
+	return expected, nil
+}
+
+// verifyChecksums compares expected checksums against the computed digests
+func verifyChecksums(expected, digests map[string]string) error {
+	for _, name := range checksumAlgorithms {
+		want, ok := expected[name]
+		if !ok {
+			continue
+		}
+		if digests[name] != want {
+			return fmt.Errorf("%w: %s expected %s, got %s", errChecksumMismatch, name, want, digests[name])
+		}
+	}
+	return nil
+}
+
+// sidecarContent returns a sha256sum compatible line for filename
+func sidecarContent(digest, filename string) string {
+	return fmt.Sprintf("%s  %s\n", digest, filename)
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Digests of "abc"
+const (
+	abcSHA256 = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	abcSHA1   = "a9993e364706816aba3e25717850c26c9cd0d89d"
+	abcMD5    = "900150983cd24fb0d6963f7d28e17f72"
+)
+
+func TestChecksumSet(t *testing.T) {
+	set := newChecksumSet()
+	set.Write([]byte("a"))
+	set.Write([]byte("bc"))
+
+	want := map[string]string{"sha256": abcSHA256, "sha1": abcSHA1, "md5": abcMD5}
+	if got := set.Digests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Digests() = %v, want %v", got, want)
+	}
+}
+
+func TestParseExpectedChecksums(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "none", values: map[string]string{}, want: map[string]string{}},
+		{name: "empty values are ignored", values: map[string]string{"sha256": " ", "md5": ""}, want: map[string]string{}},
+		{
+			name:   "hex",
+			values: map[string]string{"sha256": abcSHA256, "sha1": abcSHA1},
+			want:   map[string]string{"sha256": abcSHA256, "sha1": abcSHA1},
+		},
+		{
+			name:   "upper case hex",
+			values: map[string]string{"md5": " 900150983CD24FB0D6963F7D28E17F72 "},
+			want:   map[string]string{"md5": abcMD5},
+		},
+		{
+			name:   "base64",
+			values: map[string]string{"md5": "kAFQmDzST7DWlj99KOF/cg=="},
+			want:   map[string]string{"md5": abcMD5},
+		},
+		{
+			name:   "unknown algorithms are ignored",
+			values: map[string]string{"crc32": "352441c2"},
+			want:   map[string]string{},
+		},
+		{name: "wrong length", values: map[string]string{"sha256": abcSHA1}, wantErr: true},
+		{name: "not hex or base64", values: map[string]string{"md5": "not a checksum"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExpectedChecksums(tt.values)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseExpectedChecksums(%v) = %v, want an error", tt.values, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExpectedChecksums(%v) failed: %v", tt.values, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExpectedChecksums(%v) = %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	digests := map[string]string{"sha256": abcSHA256, "sha1": abcSHA1, "md5": abcMD5}
+
+	tests := []struct {
+		name     string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{name: "nothing expected", expected: map[string]string{}},
+		{name: "match", expected: map[string]string{"sha256": abcSHA256, "md5": abcMD5}},
+		{name: "mismatch", expected: map[string]string{"sha256": abcSHA256, "sha1": abcSHA256[:40]}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyChecksums(tt.expected, digests)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("verifyChecksums() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errChecksumMismatch) {
+				t.Errorf("verifyChecksums() = %v, want errChecksumMismatch", err)
+			}
+		})
+	}
+}
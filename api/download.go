@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+// Download modes
+const (
+	downloadStream   = "stream"   // proxy the content through this server
+	downloadRedirect = "redirect" // redirect to OneDrive's pre-authenticated download URL
+)
+
+var (
+	downloadModes    map[string]string
+	downloadModeOnce sync.Once
+)
+
+// getDownloadMode returns how downloads from remote are served. DOWNLOAD_MODE sets the
+// default and REMOTE_DOWNLOAD_MODES overrides it per remote, e.g. oned=redirect.
+func getDownloadMode(remote string) string {
+	downloadModeOnce.Do(func() {
+		downloadModes = make(map[string]string)
+		defaultMode := config.GetEnvWithDefault("DOWNLOAD_MODE", downloadStream)
+		overrides := config.GetEnvMap("REMOTE_DOWNLOAD_MODES")
+		for name := range rootFolders {
+			mode := defaultMode
+			if override, ok := overrides[name]; ok {
+				mode = override
+			}
+			if mode != downloadStream && mode != downloadRedirect {
+				log.Printf("Ignoring invalid download mode %q for %s", mode, name)
+				mode = downloadStream
+			}
+			downloadModes[name] = mode
+		}
+	})
+	return downloadModes[remote]
+}
+
+// remoteFileReader reads a OneDrive file as a seekable stream. The content is opened lazily
+// at the current offset, so seeking to serve a range costs no request of its own.
+type remoteFileReader struct {
+	ctx         context.Context
+	client      *azure.AzureClient
+	downloadURL string
+	size        int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads from the current offset, opening the content there if needed
+func (r *remoteFileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.client.OpenDownloadRange(r.ctx, http.DefaultClient, r.downloadURL, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = fmt.Errorf("download ended %d bytes early: %w", r.size-r.offset, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// Seek moves the offset the next Read starts from
+func (r *remoteFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the open content, if any
+func (r *remoteFileReader) Close() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	return nil
+}
+
+// itemETag returns the entity tag downloads of item are served with: its QuickXorHash, which
+// only changes with the content, or else the drive's own eTag
+func itemETag(item *azure.DriveItem) string {
+	if item.File != nil && item.File.Hashes.QuickXorHash != "" {
+		return strconv.Quote(item.File.Hashes.QuickXorHash)
+	}
+	if item.ETag == "" || strings.HasPrefix(item.ETag, `"`) {
+		return item.ETag
+	}
+	return strconv.Quote(item.ETag)
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since against a file, as
+// http.ServeContent does for streamed downloads
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
+
+// DownloadHandler handles GET /download/{remote}/{path}, which serves a file through Graph
+// rather than the remote's index: streamed with support for ranges and conditional requests,
+// or redirected to OneDrive's pre-authenticated download URL depending on the remote
+func DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, If-Range, If-None-Match, If-Modified-Since")
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Range, Content-Length, Content-Disposition, ETag, Last-Modified")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	remote := r.PathValue("remote")
+	if _, ok := rootFolders[remote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+	relPath := cleanRemotePath(r.PathValue("path"))
+	if relPath == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("path is required"), "Invalid request")
+		return
+	}
+
+	client, err := openRemote(r.Context(), remote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	item, err := client.GetItemByPath(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		if isNotFound(err) {
+			sendErrorResponse(w, http.StatusNotFound, err, "File not found")
+			return
+		}
+		sendErrorResponse(w, http.StatusBadGateway, err, "Failed to fetch item")
+		return
+	}
+	if item.Folder != nil || item.DownloadURL == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("%s is not a file", relPath), "Invalid request")
+		return
+	}
+
+	etag := itemETag(item)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if getDownloadMode(remote) == downloadRedirect {
+		if !item.LastModifiedDateTime.IsZero() {
+			w.Header().Set("Last-Modified", item.LastModifiedDateTime.UTC().Format(http.TimeFormat))
+		}
+		if notModified(r, etag, item.LastModifiedDateTime) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		// The download URL expires after a short while, so neither side may keep it
+		w.Header().Set("Cache-Control", "no-store")
+		log.Printf("Redirecting download of %s on %s", relPath, remote)
+		http.Redirect(w, r, item.DownloadURL, http.StatusFound)
+		return
+	}
+
+	// Large files take longer to stream than the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Unable to clear write deadline for download: %v", err)
+	}
+
+	var contentType string
+	if item.File != nil {
+		contentType = item.File.MimeType
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(item.Name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": item.Name}))
+
+	reader := &remoteFileReader{
+		ctx:         r.Context(),
+		client:      client,
+		downloadURL: item.DownloadURL,
+		size:        item.Size,
+	}
+	defer reader.Close()
+
+	log.Printf("Serving %s (%d bytes) from %s", relPath, item.Size, remote)
+	http.ServeContent(w, r, item.Name, item.LastModifiedDateTime, reader)
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// defaultExpiryCheckInterval is how often the janitor looks for expired uploads
+	defaultExpiryCheckInterval = time.Minute
+	// maxExpiresIn is the longest lifetime an upload may be given
+	maxExpiresIn = 365 * 24 * time.Hour
+	// expiryRetryDelay is how long the janitor waits before retrying a failed deletion; the
+	// wait doubles with every further failure, up to maxExpiryRetryDelay
+	expiryRetryDelay    = time.Minute
+	maxExpiryRetryDelay = 24 * time.Hour
+	// defaultExpiryMaxAttempts is how many deletions are tried before an expiration is given up
+	defaultExpiryMaxAttempts = 10
+)
+
+// parseExpiresIn parses a lifetime such as 90m, 12h or 7d; a bare number is seconds.
+// An empty value means the upload does not expire.
+func parseExpiresIn(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	var (
+		d   time.Duration
+		err error
+	)
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n float64
+		n, err = strconv.ParseFloat(days, 64)
+		d = time.Duration(n * float64(24*time.Hour))
+	} else if seconds, convErr := strconv.ParseInt(value, 10, 64); convErr == nil {
+		d = time.Duration(seconds) * time.Second
+	} else {
+		d, err = time.ParseDuration(value)
+	}
+	if err != nil || d <= 0 || d > maxExpiresIn {
+		return 0, fmt.Errorf("invalid expiresIn: %s (must be a duration such as 12h or 7d, at most 365d)", value)
+	}
+	return d, nil
+}
+
+// Expiration is an uploaded file scheduled for deletion
+type Expiration struct {
+	ID            string    `json:"id"`
+	Remote        string    `json:"remote"`
+	ItemID        string    `json:"itemId"`
+	SidecarItemID string    `json:"sidecarItemId,omitempty"`
+	Path          string    `json:"path"`
+	DownloadURL   string    `json:"downloadURL,omitempty"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Attempts      int       `json:"attempts,omitempty"` // failed deletions
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitempty"` // set after a failed deletion
+	Failed        bool      `json:"failed,omitempty"`        // given up after too many failures
+}
+
+// auditRecord is a line of the expiry audit log
+type auditRecord struct {
+	Time         time.Time  `json:"time"`
+	Action       string     `json:"action"` // deleted, missing, failed, abandoned or extended
+	ExpirationID string     `json:"expirationId"`
+	Remote       string     `json:"remote"`
+	ItemID       string     `json:"itemId"`
+	Path         string     `json:"path"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// ExpiryStore keeps pending expirations in memory and persists each one as a JSON file.
+// Every deletion and extension is appended to an audit log.
+type ExpiryStore struct {
+	dir       string
+	auditPath string
+	mu        sync.Mutex
+	entries   map[string]*Expiration
+}
+
+// NewExpiryStore opens the expiry store in dir, loading the expirations of previous runs
+func NewExpiryStore(dir, auditPath string) (*ExpiryStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create expiry directory: %v", err)
+	}
+
+	store := &ExpiryStore{
+		dir:       dir,
+		auditPath: auditPath,
+		entries:   make(map[string]*Expiration),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expiry directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Skipping unreadable expiry file %s: %v", path, err)
+			continue
+		}
+
+		var expiration Expiration
+		if err := json.Unmarshal(data, &expiration); err != nil || expiration.ID == "" {
+			log.Printf("Skipping invalid expiry file %s: %v", path, err)
+			continue
+		}
+		store.entries[expiration.ID] = &expiration
+	}
+
+	log.Printf("Loaded %d pending expirations from %s", len(store.entries), dir)
+	return store, nil
+}
+
+// save writes an expiration to disk atomically. Callers must hold s.mu.
+func (s *ExpiryStore) save(expiration *Expiration) error {
+	data, err := json.MarshalIndent(expiration, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, expiration.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// audit appends a record for expiration to the audit log. Callers must hold s.mu.
+func (s *ExpiryStore) audit(action string, expiration *Expiration, err error) {
+	record := auditRecord{
+		Time:         time.Now(),
+		Action:       action,
+		ExpirationID: expiration.ID,
+		Remote:       expiration.Remote,
+		ItemID:       expiration.ItemID,
+		Path:         expiration.Path,
+	}
+	if action == "extended" {
+		expiresAt := expiration.ExpiresAt
+		record.ExpiresAt = &expiresAt
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	log.Printf("Expiry audit: %s %s:%s (%s)", action, expiration.Remote, expiration.Path, expiration.ID)
+
+	data, _ := json.Marshal(record)
+	file, openErr := os.OpenFile(s.auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if openErr != nil {
+		log.Printf("Failed to open expiry audit log: %v", openErr)
+		return
+	}
+	defer file.Close()
+	if _, writeErr := file.Write(append(data, '\n')); writeErr != nil {
+		log.Printf("Failed to write expiry audit log: %v", writeErr)
+	}
+}
+
+// Add schedules a new expiration
+func (s *ExpiryStore) Add(expiration *Expiration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	expiration.ID = id
+	expiration.CreatedAt = time.Now()
+	if err := s.save(expiration); err != nil {
+		return err
+	}
+	s.entries[expiration.ID] = expiration
+	return nil
+}
+
+// Get returns a copy of the expiration with the given ID
+func (s *ExpiryStore) Get(id string) (Expiration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiration, ok := s.entries[id]
+	if !ok {
+		return Expiration{}, false
+	}
+	return *expiration, true
+}
+
+// List returns the pending expirations of remote (all if empty), soonest first
+func (s *ExpiryStore) List(remote string) []Expiration {
+	s.mu.Lock()
+	list := make([]Expiration, 0, len(s.entries))
+	for _, expiration := range s.entries {
+		if remote == "" || expiration.Remote == remote {
+			list = append(list, *expiration)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ExpiresAt.Before(list[j].ExpiresAt)
+	})
+	return list
+}
+
+// Extend moves the expiry of an expiration to expiresAt. An expiration that was given up
+// is tried again from then on.
+func (s *ExpiryStore) Extend(id string, expiresAt time.Time) (Expiration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiration, ok := s.entries[id]
+	if !ok {
+		return Expiration{}, fmt.Errorf("expiration %s not found", id)
+	}
+	expiration.ExpiresAt = expiresAt
+	expiration.Attempts, expiration.NextAttemptAt, expiration.Failed = 0, time.Time{}, false
+	if err := s.save(expiration); err != nil {
+		return Expiration{}, err
+	}
+	s.audit("extended", expiration, nil)
+	return *expiration, nil
+}
+
+// due returns the expirations that expired before now and are not waiting to be retried
+// or given up
+func (s *ExpiryStore) due(now time.Time) []Expiration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []Expiration
+	for _, expiration := range s.entries {
+		if !expiration.ExpiresAt.After(now) && !expiration.NextAttemptAt.After(now) && !expiration.Failed {
+			list = append(list, *expiration)
+		}
+	}
+	return list
+}
+
+// expiryBackoff returns how long to wait before retrying a deletion that has failed attempts times
+func expiryBackoff(attempts int) time.Duration {
+	delay := expiryRetryDelay
+	for i := 1; i < attempts && delay < maxExpiryRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxExpiryRetryDelay)
+}
+
+// finish records the outcome of deleting an expired item. Deleted and missing items leave
+// the store. Failed deletions stay to be tried again with exponential backoff, until
+// EXPIRY_MAX_ATTEMPTS have failed and the expiration is marked failed; it then stays in
+// the store for an admin to look at or extend.
+func (s *ExpiryStore) finish(id string, action string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiration, ok := s.entries[id]
+	if !ok {
+		return
+	}
+
+	if action == "failed" {
+		expiration.Attempts++
+		expiration.LastError = err.Error()
+		if expiration.Attempts >= config.GetEnvIntWithDefault("EXPIRY_MAX_ATTEMPTS", defaultExpiryMaxAttempts) {
+			expiration.Failed = true
+			action = "abandoned"
+		} else {
+			expiration.NextAttemptAt = time.Now().Add(expiryBackoff(expiration.Attempts))
+		}
+		s.audit(action, expiration, err)
+		if saveErr := s.save(expiration); saveErr != nil {
+			log.Printf("Failed to persist expiration %s: %v", id, saveErr)
+		}
+		return
+	}
+	s.audit(action, expiration, err)
+	delete(s.entries, id)
+	os.Remove(filepath.Join(s.dir, id+".json"))
+}
+
+var (
+	expiryStore     *ExpiryStore
+	expiryStoreErr  error
+	expiryStoreOnce sync.Once
+)
+
+// getExpiryStore opens the shared expiry store on first use. The directory is taken from
+// EXPIRY_DIR, the audit log from EXPIRY_AUDIT_LOG (default: audit.log in that directory).
+// Without EXPIRY_DIR the store lives in the system temp directory, where pending deletions
+// are lost when it is cleared on reboot, so deployments should point it at persistent storage.
+func getExpiryStore() (*ExpiryStore, error) {
+	expiryStoreOnce.Do(func() {
+		dir := config.GetEnvWithDefault("EXPIRY_DIR", "")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "ksau-expirations")
+			log.Printf("EXPIRY_DIR is not set, keeping expirations in %s; files may never be deleted if it is cleared", dir)
+		}
+		auditPath := config.GetEnvWithDefault("EXPIRY_AUDIT_LOG", filepath.Join(dir, "audit.log"))
+		expiryStore, expiryStoreErr = NewExpiryStore(dir, auditPath)
+	})
+	return expiryStore, expiryStoreErr
+}
+
+// scheduleUploadExpiry records an uploaded file, and its checksum sidecar if any, for deletion
+// once spec.ExpiresIn has passed. The result carries the expiry, or why it could not be recorded.
+func scheduleUploadExpiry(spec *uploadSpec, result *uploadResult, sidecarItemID string) {
+	if spec.ExpiresIn <= 0 {
+		return
+	}
+
+	store, err := getExpiryStore()
+	if err == nil {
+		expiration := &Expiration{
+			Remote:        spec.Remote,
+			ItemID:        result.FileID,
+			SidecarItemID: sidecarItemID,
+			Path:          filepath.Join(rootFolders[spec.Remote], spec.RemoteFolder, result.FileName),
+			DownloadURL:   result.DownloadURL,
+			ExpiresAt:     time.Now().Add(spec.ExpiresIn),
+		}
+		if err = store.Add(expiration); err == nil {
+			result.ExpiresAt = expiration.ExpiresAt
+			log.Printf("%s on %s expires at %s", expiration.Path, spec.Remote, expiration.ExpiresAt.Format(time.RFC3339))
+			return
+		}
+	}
+	log.Printf("Unable to schedule expiry of %s: %v", result.FileName, err)
+	result.ExpiryError = err.Error()
+}
+
+// StartExpiryJanitor starts the goroutine that deletes expired uploads, checking every
+// EXPIRY_CHECK_INTERVAL until ctx is done
+func StartExpiryJanitor(ctx context.Context) {
+	store, err := getExpiryStore()
+	if err != nil {
+		log.Printf("Expiry janitor not started: %v", err)
+		return
+	}
+
+	interval := config.GetEnvDurationWithDefault("EXPIRY_CHECK_INTERVAL", defaultExpiryCheckInterval)
+	log.Printf("Expiry janitor checking every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			sweepExpired(ctx, store, time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// sweepExpired deletes every item that expired before now
+func sweepExpired(ctx context.Context, store *ExpiryStore, now time.Time) {
+	clients := make(map[string]*azure.AzureClient)
+	for _, expiration := range store.due(now) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		client, ok := clients[expiration.Remote]
+		if !ok {
+			var err error
+			client, err = newRemoteClient(expiration.Remote)
+			if err != nil {
+				store.finish(expiration.ID, "failed", err)
+				continue
+			}
+			clients[expiration.Remote] = client
+		}
+
+		action, err := deleteExpired(ctx, client, expiration)
+		store.finish(expiration.ID, action, err)
+	}
+}
+
+// deleteExpired deletes an expired item and its sidecar. An item that is already gone is
+// reported as missing rather than failed.
+func deleteExpired(ctx context.Context, client *azure.AzureClient, expiration Expiration) (string, error) {
+	if expiration.SidecarItemID != "" {
+		if err := client.DeleteItem(ctx, http.DefaultClient, expiration.SidecarItemID); err != nil && !isNotFound(err) {
+			log.Printf("Failed to delete sidecar of %s: %v", expiration.Path, err)
+		}
+	}
+
+	err := client.DeleteItem(ctx, http.DefaultClient, expiration.ItemID)
+	switch {
+	case err == nil:
+		return "deleted", nil
+	case isNotFound(err):
+		return "missing", nil
+	default:
+		return "failed", err
+	}
+}
+
+// isNotFound reports whether err is a Graph 404
+func isNotFound(err error) bool {
+	var statusErr *azure.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseExpiresIn(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "90m", want: 90 * time.Minute},
+		{value: " 12h ", want: 12 * time.Hour},
+		{value: "7d", want: 7 * 24 * time.Hour},
+		{value: "1.5d", want: 36 * time.Hour},
+		{value: "3600", want: time.Hour},
+		{value: "365d", want: maxExpiresIn},
+		{value: "366d", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-1h", wantErr: true},
+		{value: "d", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExpiresIn(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseExpiresIn(%q) = %v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseExpiresIn(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpiryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{11, 1024 * time.Minute},
+		{12, maxExpiryRetryDelay},
+		{100, maxExpiryRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := expiryBackoff(tt.attempts); got != tt.want {
+			t.Errorf("expiryBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestExpiryStoreRetries(t *testing.T) {
+	t.Setenv("EXPIRY_MAX_ATTEMPTS", "3")
+	dir := t.TempDir()
+	store, err := NewExpiryStore(dir, filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("NewExpiryStore failed: %v", err)
+	}
+	expiration := &Expiration{Remote: "oned", ItemID: "item", ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := store.Add(expiration); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if due := store.due(time.Now().Add(48 * time.Hour)); len(due) != 1 {
+			t.Fatalf("attempt %d: %d expirations due, want 1", attempt, len(due))
+		}
+		store.finish(expiration.ID, "failed", errors.New("delete failed"))
+
+		got, _ := store.Get(expiration.ID)
+		if got.Attempts != attempt || got.LastError != "delete failed" {
+			t.Errorf("attempt %d: Attempts = %d, LastError = %q", attempt, got.Attempts, got.LastError)
+		}
+		if len(store.due(time.Now())) != 0 {
+			t.Errorf("attempt %d: expiration is due again right away", attempt)
+		}
+	}
+
+	got, _ := store.Get(expiration.ID)
+	if !got.Failed {
+		t.Errorf("expiration not marked failed after 3 attempts")
+	}
+	if due := store.due(time.Now().Add(48 * time.Hour)); len(due) != 0 {
+		t.Errorf("failed expiration is still due")
+	}
+
+	// Extending gives it a fresh set of attempts
+	if _, err := store.Extend(expiration.ID, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Extend failed: %v", err)
+	}
+	if due := store.due(time.Now()); len(due) != 1 || due[0].Attempts != 0 || due[0].Failed {
+		t.Errorf("extended expiration not due with a fresh set of attempts: %+v", due)
+	}
+}
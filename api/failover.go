@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+var (
+	failoverChains map[string][]string
+	failoverOnce   sync.Once
+)
+
+// getFailoverChain returns the remotes uploads to remote fail over to, in order.
+// Chains are read from REMOTE_FAILOVER, e.g. oned=saurajcf|hakimionedrive,saurajcf=oned
+func getFailoverChain(remote string) []string {
+	failoverOnce.Do(func() {
+		failoverChains = make(map[string][]string)
+		for primary, value := range config.GetEnvMap("REMOTE_FAILOVER") {
+			if _, ok := rootFolders[primary]; !ok {
+				log.Printf("Ignoring failover chain for unknown remote %s", primary)
+				continue
+			}
+			var chain []string
+			for _, fallback := range strings.Split(value, "|") {
+				fallback = strings.TrimSpace(fallback)
+				if _, ok := rootFolders[fallback]; !ok || fallback == primary {
+					log.Printf("Ignoring failover remote %q for %s", fallback, primary)
+					continue
+				}
+				chain = append(chain, fallback)
+			}
+			if len(chain) > 0 {
+				failoverChains[primary] = chain
+				log.Printf("Uploads to %s fail over to %s", primary, strings.Join(chain, ", "))
+			}
+		}
+	})
+	return failoverChains[remote]
+}
+
+// failoverError is an upload error together with every remote the upload was tried on
+type failoverError struct {
+	err       error
+	attempted []string
+}
+
+// Error names the remotes that were tried
+func (e *failoverError) Error() string {
+	return fmt.Sprintf("%v (tried %s)", e.err, strings.Join(e.attempted, ", "))
+}
+
+// Unwrap returns the error of the last remote
+func (e *failoverError) Unwrap() error {
+	return e.err
+}
+
+// withAttempts records the remotes tried in err if the upload failed over at least once
+func withAttempts(err error, attempted []string) error {
+	if len(attempted) < 2 {
+		return err
+	}
+	return &failoverError{err: err, attempted: attempted}
+}
+
+// attemptedRemotes returns the remotes a failed upload was tried on, nil if it never failed over
+func attemptedRemotes(err error) []string {
+	var failover *failoverError
+	if errors.As(err, &failover) {
+		return failover.attempted
+	}
+	return nil
+}
+
+// shouldFailover reports whether an upload that failed with err might succeed on another remote.
+// Cancellations and errors caused by the request itself, such as conflicts, would fail there too.
+func shouldFailover(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, azure.ErrConflict) || errors.Is(err, errChecksumMismatch) {
+		return false
+	}
+
+	var statusErr *azure.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 {
+		// Auth, throttling and lock errors belong to the remote rather than the request
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusLocked, http.StatusTooManyRequests:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// openRemote creates a client with a valid token for remote, after checking that size
+// bytes (-1 if unknown) fit on it
+func openRemote(ctx context.Context, remote string, size int64) (*azure.AzureClient, error) {
+	if err := checkQuota(ctx, remote, size); err != nil {
+		return nil, err
+	}
+	client, err := newRemoteClient(remote)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.EnsureTokenValid(ctx, http.DefaultClient); err != nil {
+		return nil, fmt.Errorf("failed to refresh token for %s: %w", remote, err)
+	}
+	return client, nil
+}
+
+// claimRemote is openRemote that claims the space as well. The returned func releases
+// the claim, and must be called if the upload does not go through.
+func claimRemote(ctx context.Context, remote string, size int64) (*azure.AzureClient, func(), error) {
+	release, err := claimQuota(ctx, remote, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := openRemote(ctx, remote, -1)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return client, release, nil
+}
+
+// connectRemote returns a client for opts.Remote. If that remote cannot be used, because its
+// token cannot be refreshed or size bytes do not fit on it, the remotes of its failover chain
+// are tried in turn. opts is moved to the remote that was picked and keeps the rest of the chain.
+func connectRemote(ctx context.Context, opts *uploadOptions, size int64) (*azure.AzureClient, error) {
+	chain := append([]string{opts.Remote}, getFailoverChain(opts.Remote)...)
+	var attempted []string
+	for i, remote := range chain {
+		client, err := openRemote(ctx, remote, size)
+		if err == nil {
+			if i > 0 {
+				log.Printf("Remote %s is unavailable, using %s", opts.Remote, remote)
+			}
+			opts.Remote = remote
+			opts.Fallbacks = chain[i+1:]
+			opts.Attempted = attempted
+			return client, nil
+		}
+		attempted = append(attempted, remote)
+		if i == len(chain)-1 {
+			return nil, withAttempts(err, attempted)
+		}
+		log.Printf("Unable to use remote %s, failing over: %v", remote, err)
+	}
+	return nil, fmt.Errorf("no remote to connect to")
+}
+
+// nextFailoverRemote takes remotes off spec.Fallbacks until one has room for the file and
+// a valid token, and returns it with its client and the release func of the space claimed
+// on it. Remotes that cannot be used are skipped.
+func nextFailoverRemote(ctx context.Context, spec *uploadSpec) (string, *azure.AzureClient, func(), []string) {
+	var skipped []string
+	for len(spec.Fallbacks) > 0 {
+		remote := spec.Fallbacks[0]
+		spec.Fallbacks = spec.Fallbacks[1:]
+		client, release, err := claimRemote(ctx, remote, spec.Size)
+		if err != nil {
+			log.Printf("Skipping failover remote %s: %v", remote, err)
+			skipped = append(skipped, remote)
+			continue
+		}
+		return remote, client, release, skipped
+	}
+	return "", nil, nil, skipped
+}
+
+// uploadWithFailover uploads body to spec.Remote and, if that fails in a way another remote
+// might not, to the remotes of spec.Fallbacks in turn. Only seekable bodies, i.e. spooled
+// files, can be sent again. spec is moved to the remote that took the upload, and that
+// remote's client is returned with the result. The space claimed for a failed upload is
+// given back.
+func uploadWithFailover(ctx context.Context, client *azure.AzureClient, spec *uploadSpec, body io.Reader, onVerify func()) (*uploadResult, *azure.AzureClient, error) {
+	attempted := append([]string(nil), spec.Attempted...)
+	for {
+		attempted = append(attempted, spec.Remote)
+		result, err := spec.upload(ctx, client, body, onVerify)
+		if err == nil {
+			result.Remote = spec.Remote
+			result.AttemptedRemotes = attempted
+			return result, client, nil
+		}
+
+		spec.releaseQuota()
+
+		seeker, seekable := body.(io.Seeker)
+		if !seekable || len(spec.Fallbacks) == 0 || !shouldFailover(err) {
+			return nil, client, withAttempts(err, attempted)
+		}
+		next, nextClient, release, skipped := nextFailoverRemote(ctx, spec)
+		attempted = append(attempted, skipped...)
+		if nextClient == nil {
+			return nil, client, withAttempts(err, attempted)
+		}
+		if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+			release()
+			return nil, client, withAttempts(err, attempted)
+		}
+
+		log.Printf("Upload of %s to %s failed, failing over to %s: %v", spec.Filename, spec.Remote, next, err)
+		spec.moveTo(next, nextClient)
+		spec.quotaRelease = release
+		client = nextClient
+
+		// The upload now counts against the limits of the remote it moved to
+		if spec.ticket != nil {
+			if waitErr := spec.ticket.moveTo(ctx, next); waitErr != nil {
+				spec.releaseQuota()
+				return nil, client, withAttempts(waitErr, attempted)
+			}
+		}
+	}
+}
+
+// moveTo points spec at remote, keeping its folder and file name
+func (s *uploadSpec) moveTo(remote string, client *azure.AzureClient) {
+	s.Remote = remote
+	s.Params.RemoteFilePath = filepath.Join(rootFolders[remote], s.RemoteFolder, s.Filename)
+	s.Params.AccessToken = client.AccessToken
+}
@@ -0,0 +1,481 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+const (
+	// maxFilesRequestSize limits the JSON body of /files requests
+	maxFilesRequestSize = 64 << 10
+	// copyPollInterval is how long to wait before first checking on a copy
+	copyPollInterval = 2 * time.Second
+	// maxCopyPollInterval caps the backoff between checks on a long copy
+	maxCopyPollInterval = 30 * time.Second
+	// maxCopyStatusErrors is how many failed checks in a row give a copy up
+	maxCopyStatusErrors = 5
+)
+
+// fileInfo describes a drive item, with its path relative to the remote's root folder
+type fileInfo struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Path         string     `json:"path"`
+	Type         string     `json:"type"` // file or folder
+	Size         int64      `json:"size"`
+	MimeType     string     `json:"mimeType,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ModifiedAt   time.Time  `json:"modifiedAt"`
+	QuickXorHash string     `json:"quickXorHash,omitempty"`
+	SHA1         string     `json:"sha1,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	ChildCount   *int       `json:"childCount,omitempty"`
+	DownloadURL  string     `json:"downloadURL,omitempty"` // index URL, files only
+	Children     []fileInfo `json:"children,omitempty"`
+	HasMore      bool       `json:"hasMore,omitempty"` // more children than returned
+}
+
+// newFileInfo describes item, found at relPath within remote
+func newFileInfo(remote, relPath string, item *azure.DriveItem) fileInfo {
+	info := fileInfo{
+		ID:         item.ID,
+		Name:       item.Name,
+		Path:       relPath,
+		Type:       "file",
+		Size:       item.Size,
+		CreatedAt:  item.CreatedDateTime,
+		ModifiedAt: item.LastModifiedDateTime,
+	}
+	if item.Folder != nil {
+		info.Type = "folder"
+		childCount := item.Folder.ChildCount
+		info.ChildCount = &childCount
+	}
+	if item.File != nil {
+		info.MimeType = item.File.MimeType
+		info.QuickXorHash = item.File.Hashes.QuickXorHash
+		info.SHA1 = item.File.Hashes.SHA1Hash
+		info.SHA256 = item.File.Hashes.SHA256Hash
+		folder := filepath.Dir(relPath)
+		if folder == "." {
+			folder = ""
+		}
+		info.DownloadURL = buildDownloadURL(remote, folder, item.Name)
+	}
+	return info
+}
+
+// remoteItemPath returns the drive path of relPath within remote's root folder
+func remoteItemPath(remote, relPath string) string {
+	return filepath.Join(rootFolders[remote], relPath)
+}
+
+// graphErrorStatus maps a Graph error to the status code returned to the client
+func graphErrorStatus(err error) int {
+	if errors.Is(err, azure.ErrConflict) {
+		return http.StatusConflict
+	}
+	var statusErr *azure.StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound:
+			return statusErr.StatusCode
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// filesRequest is the JSON body of POST and PATCH /files/{remote}/{path}
+type filesRequest struct {
+	Action           string `json:"action"`      // POST: mkdir or copy
+	Destination      string `json:"destination"` // copy and move; a trailing / keeps the name
+	Name             string `json:"name"`        // rename in place
+	Parents          bool   `json:"parents"`     // mkdir: create missing parent folders
+	ConflictBehavior string `json:"conflictBehavior"`
+}
+
+// FilesHandler serves /files/{remote}/{path}: GET describes an item and lists a folder's
+// children, POST creates a folder or copies an item, PATCH moves or renames it and DELETE
+// moves it to the recycle bin. Paths are relative to the remote's root folder. Every method
+// but GET changes the drive and needs the admin token.
+func FilesHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" && !checkAdmin(w, r) {
+		return
+	}
+
+	remote := r.PathValue("remote")
+	if _, ok := rootFolders[remote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+	relPath := cleanRemotePath(r.PathValue("path"))
+
+	var req filesRequest
+	if r.Method == "POST" || r.Method == "PATCH" {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxFilesRequestSize)).Decode(&req); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err), "Invalid request")
+			return
+		}
+		if err := validateConflictBehavior(req.ConflictBehavior); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+			return
+		}
+	}
+
+	// The remote's root folder itself can only be listed
+	if relPath == "" && r.Method != "GET" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("path is required"), "Invalid request")
+		return
+	}
+
+	client, err := openRemote(r.Context(), remote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	switch {
+	case r.Method == "GET":
+		statFile(w, r, client, remote, relPath)
+	case r.Method == "POST" && req.Action == "mkdir":
+		makeFolder(w, r, client, remote, relPath, &req)
+	case r.Method == "POST" && req.Action == "copy":
+		copyFile(w, r, client, remote, relPath, &req)
+	case r.Method == "POST":
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid action: %q (must be mkdir or copy)", req.Action), "Invalid request")
+	case r.Method == "PATCH":
+		moveFile(w, r, client, remote, relPath, &req)
+	case r.Method == "DELETE":
+		deleteFile(w, r, client, remote, relPath)
+	default:
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+	}
+}
+
+// writeFileInfo writes a successful /files response
+func writeFileInfo(w http.ResponseWriter, statusCode int, info fileInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   info,
+	})
+}
+
+// statFile describes the item at relPath, with the first page of a folder's children
+func statFile(w http.ResponseWriter, r *http.Request, client *azure.AzureClient, remote, relPath string) {
+	item, err := client.GetItemWithChildren(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to fetch item")
+		return
+	}
+
+	info := newFileInfo(remote, relPath, item)
+	if item.Folder != nil {
+		info.Children = make([]fileInfo, 0, len(item.Children))
+		for i := range item.Children {
+			child := &item.Children[i]
+			info.Children = append(info.Children, newFileInfo(remote, filepath.Join(relPath, child.Name), child))
+		}
+		info.HasMore = item.ChildrenNextLink != ""
+	}
+	writeFileInfo(w, http.StatusOK, info)
+}
+
+// makeFolder creates the folder at relPath, and with parents set any missing folders above it
+func makeFolder(w http.ResponseWriter, r *http.Request, client *azure.AzureClient, remote, relPath string, req *filesRequest) {
+	parent, name := filepath.Dir(relPath), filepath.Base(relPath)
+	if parent == "." {
+		parent = ""
+	}
+
+	if req.Parents && parent != "" {
+		if err := ensureFolders(r.Context(), client, remote, parent); err != nil {
+			sendErrorResponse(w, graphErrorStatus(err), err, "Failed to create parent folders")
+			return
+		}
+	}
+
+	item, err := client.CreateFolder(r.Context(), http.DefaultClient, remoteItemPath(remote, parent), name, req.ConflictBehavior)
+	if err != nil {
+		if isNotFound(err) {
+			sendErrorResponse(w, http.StatusNotFound, err, "Parent folder not found")
+			return
+		}
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to create folder")
+		return
+	}
+
+	log.Printf("Created folder %s on %s", remoteItemPath(remote, filepath.Join(parent, item.Name)), remote)
+	writeFileInfo(w, http.StatusCreated, newFileInfo(remote, filepath.Join(parent, item.Name), item))
+}
+
+// ensureFolders creates each missing folder of relPath, from the top down
+func ensureFolders(ctx context.Context, client *azure.AzureClient, remote, relPath string) error {
+	var current string
+	for _, name := range strings.Split(relPath, "/") {
+		parent := current
+		current = filepath.Join(current, name)
+
+		item, err := client.GetItemByPath(ctx, http.DefaultClient, remoteItemPath(remote, current))
+		if err == nil {
+			if item.Folder == nil {
+				return fmt.Errorf("%s is not a folder", current)
+			}
+			continue
+		}
+		if !isNotFound(err) {
+			return err
+		}
+
+		// A folder created concurrently is as good as our own
+		_, err = client.CreateFolder(ctx, http.DefaultClient, remoteItemPath(remote, parent), name, azure.ConflictFail)
+		if err != nil && !errors.Is(err, azure.ErrConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupDestination resolves the folder a copy or move goes to, which must exist
+func lookupDestination(ctx context.Context, client *azure.AzureClient, remote, relPath, folder string) (*azure.DriveItem, int, error) {
+	if folder == relPath || strings.HasPrefix(folder, relPath+"/") {
+		return nil, http.StatusBadRequest, fmt.Errorf("cannot move or copy %s into itself", relPath)
+	}
+
+	item, err := client.GetItemByPath(ctx, http.DefaultClient, remoteItemPath(remote, folder))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, http.StatusNotFound, fmt.Errorf("destination folder %s not found: %w", folder, err)
+		}
+		return nil, graphErrorStatus(err), err
+	}
+	if item.Folder == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("destination %s is not a folder", folder)
+	}
+	return item, 0, nil
+}
+
+// moveFile moves the item at relPath to destination, or renames it in place to name
+func moveFile(w http.ResponseWriter, r *http.Request, client *azure.AzureClient, remote, relPath string, req *filesRequest) {
+	if (req.Destination == "") == (req.Name == "") {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("either destination or name is required"), "Invalid request")
+		return
+	}
+
+	source, err := client.GetItemByPath(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to fetch item")
+		return
+	}
+
+	var parentID string
+	folder, name := filepath.Dir(relPath), cleanFilename(req.Name)
+	if folder == "." {
+		folder = ""
+	}
+	if req.Destination != "" {
+		folder, name = resolveDestination(req.Destination, relPath)
+		destination, status, err := lookupDestination(r.Context(), client, remote, relPath, folder)
+		if err != nil {
+			sendErrorResponse(w, status, err, "Invalid destination")
+			return
+		}
+		parentID = destination.ID
+	}
+	if name == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid name: %q", req.Name), "Invalid request")
+		return
+	}
+
+	item, err := client.MoveItem(r.Context(), http.DefaultClient, source.ID, parentID, name, req.ConflictBehavior)
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to move item")
+		return
+	}
+
+	newPath := filepath.Join(folder, item.Name)
+	log.Printf("Moved %s to %s on %s", relPath, newPath, remote)
+	writeFileInfo(w, http.StatusOK, newFileInfo(remote, newPath, item))
+}
+
+// copyFile starts a server side copy of the item at relPath and tracks it as a job
+func copyFile(w http.ResponseWriter, r *http.Request, client *azure.AzureClient, remote, relPath string, req *filesRequest) {
+	if req.Destination == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("destination is required"), "Invalid request")
+		return
+	}
+	folder, name := resolveDestination(req.Destination, relPath)
+	if name == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid destination: %s", req.Destination), "Invalid request")
+		return
+	}
+
+	store, err := getJobStore()
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Job store unavailable")
+		return
+	}
+	jobID, err := newID()
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to create job")
+		return
+	}
+
+	source, err := client.GetItemByPath(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to fetch item")
+		return
+	}
+	destination, status, err := lookupDestination(r.Context(), client, remote, relPath, folder)
+	if err != nil {
+		sendErrorResponse(w, status, err, "Invalid destination")
+		return
+	}
+
+	parent := azure.ItemReference{ID: destination.ID, DriveID: client.DriveID}
+	monitorURL, err := client.CopyItem(r.Context(), http.DefaultClient, source.ID, parent, name, req.ConflictBehavior)
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to copy item")
+		return
+	}
+
+	job := &Job{
+		ID:           jobID,
+		State:        JobCopying,
+		Remote:       remote,
+		RemoteFolder: folder,
+		FileName:     name,
+		FileSize:     source.Size,
+		SourceRemote: remote,
+		SourcePath:   relPath,
+	}
+	if err := store.Create(job); err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to create job")
+		return
+	}
+	log.Printf("Copying %s to %s on %s as job %s", relPath, filepath.Join(folder, name), remote, job.ID)
+	go monitorCopy(store, job.ID, client, monitorURL, remote, folder)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "accepted",
+		"message":   "Copy started",
+		"jobId":     job.ID,
+		"statusURL": "/jobs/" + job.ID,
+		"path":      filepath.Join(folder, name),
+	})
+}
+
+// monitorCopy polls the monitor of a copy until it completes or fails, backing off while
+// it runs, and records the outcome in the job
+func monitorCopy(store *JobStore, jobID string, client *azure.AzureClient, monitorURL, remote, folder string) {
+	ctx := context.Background()
+	interval := copyPollInterval
+	failures := 0
+	for {
+		time.Sleep(interval)
+		interval = min(interval*3/2, maxCopyPollInterval)
+
+		status, err := client.GetCopyStatus(ctx, http.DefaultClient, monitorURL)
+		if err != nil {
+			failures++
+			log.Printf("Checking copy job %s failed (%d/%d): %v", jobID, failures, maxCopyStatusErrors, err)
+			if failures >= maxCopyStatusErrors {
+				failJob(store, jobID, err)
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		switch status.Status {
+		case azure.CopyCompleted:
+			finishCopy(ctx, store, jobID, client, status.ResourceID, remote, folder)
+			return
+		case azure.CopyFailed:
+			err := fmt.Errorf("copy failed")
+			if status.Error != nil {
+				err = fmt.Errorf("copy failed: %s: %s", status.Error.Code, status.Error.Message)
+			}
+			failJob(store, jobID, err)
+			return
+		default:
+			store.UpdateProgress(jobID, func(job *Job) {
+				job.PercentComplete = status.PercentageComplete
+			})
+		}
+	}
+}
+
+// finishCopy records a completed copy, looking up the name Graph gave it
+func finishCopy(ctx context.Context, store *JobStore, jobID string, client *azure.AzureClient, itemID, remote, folder string) {
+	var item *azure.DriveItem
+	if itemID != "" {
+		var err error
+		item, err = client.GetItem(ctx, http.DefaultClient, itemID)
+		if err != nil {
+			log.Printf("Unable to look up the copy of job %s: %v", jobID, err)
+		}
+	}
+
+	store.Update(jobID, func(job *Job) {
+		job.State = JobDone
+		job.PercentComplete = 100
+		if item != nil {
+			job.FileName = item.Name
+			job.FileSize = item.Size
+			if item.File != nil {
+				job.DownloadURL = buildDownloadURL(remote, folder, item.Name)
+				job.QuickXorHash = item.File.Hashes.QuickXorHash
+			}
+		}
+	})
+	log.Printf("Copy job %s completed", jobID)
+}
+
+// deleteFile moves the item at relPath to the recycle bin
+func deleteFile(w http.ResponseWriter, r *http.Request, client *azure.AzureClient, remote, relPath string) {
+	item, err := client.GetItemByPath(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to fetch item")
+		return
+	}
+
+	if err := client.DeleteItem(r.Context(), http.DefaultClient, item.ID); err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to delete item")
+		return
+	}
+
+	log.Printf("Deleted %s on %s", relPath, remote)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Item moved to the recycle bin",
+		"path":    relPath,
+	})
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+// JobState is the lifecycle state of an asynchronous upload job
+type JobState string
+
+// Job states
+const (
+	JobReceiving JobState = "receiving"
+	JobQueued    JobState = "queued"
+	JobUploading JobState = "uploading"
+	JobVerifying JobState = "verifying"
+	JobCopying   JobState = "copying" // server side copies
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+const (
+	// defaultJobListLimit is the number of jobs returned by GET /jobs
+	defaultJobListLimit = 50
+	// defaultJobRetention is how long finished jobs are kept on disk
+	defaultJobRetention = 7 * 24 * time.Hour
+	// jobProgressInterval is the least time between two progress writes of a job
+	jobProgressInterval = time.Second
+)
+
+// Job represents an asynchronous upload and its outcome
+type Job struct {
+	ID               string              `json:"id"`
+	State            JobState            `json:"state"`
+	Remote           string              `json:"remote"`
+	RemoteFolder     string              `json:"remoteFolder"`
+	FileName         string              `json:"fileName"`
+	FileSize         int64               `json:"fileSize"`
+	SourceURL        string              `json:"sourceURL,omitempty"`
+	SourceRemote     string              `json:"sourceRemote,omitempty"` // transfers
+	SourcePath       string              `json:"sourcePath,omitempty"`
+	Move             bool                `json:"move,omitempty"`
+	SourceDeleted    bool                `json:"sourceDeleted,omitempty"`
+	MoveError        string              `json:"moveError,omitempty"`
+	Priority         string              `json:"priority,omitempty"`
+	AttemptedRemotes []string            `json:"attemptedRemotes,omitempty"`
+	BytesSent        int64               `json:"bytesSent"`
+	PercentComplete  float64             `json:"percentComplete,omitempty"` // server side copies
+	Retries          int                 `json:"retries"`
+	DownloadURL      string              `json:"downloadURL,omitempty"`
+	QuickXorHash     string              `json:"quickXorHash,omitempty"`
+	Verified         bool                `json:"verified"`
+	Checksums        map[string]string   `json:"checksums,omitempty"`
+	SidecarURL       string              `json:"sidecarURL,omitempty"`
+	Parts            int                 `json:"parts,omitempty"` // split uploads
+	ManifestURL      string              `json:"manifestURL,omitempty"`
+	SplitURL         string              `json:"splitURL,omitempty"`
+	ShareURL         string              `json:"shareURL,omitempty"`
+	DownloadURLs     map[string]string   `json:"downloadURLs,omitempty"` // by remote, once replicated
+	Replicas         map[string]*Replica `json:"replicas,omitempty"`
+	ExpiresAt        *time.Time          `json:"expiresAt,omitempty"`
+	Error            string              `json:"error,omitempty"`
+	ErrorCode        string              `json:"errorCode,omitempty"`
+	CreatedAt        time.Time           `json:"createdAt"`
+	UpdatedAt        time.Time           `json:"updatedAt"`
+}
+
+// Finished reports whether the job reached a terminal state
+func (job *Job) Finished() bool {
+	return job.State == JobDone || job.State == JobFailed || job.State == JobCancelled
+}
+
+// JobStore keeps jobs in memory and persists each one as a JSON file
+type JobStore struct {
+	dir   string
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	saved map[string]time.Time // when each job was last written
+}
+
+// NewJobStore opens the job store in dir, loading jobs from previous runs.
+// Jobs that were still running when the server stopped are marked as failed.
+func NewJobStore(dir string, retention time.Duration) (*JobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %v", err)
+	}
+
+	store := &JobStore{
+		dir:   dir,
+		jobs:  make(map[string]*Job),
+		saved: make(map[string]time.Time),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Skipping unreadable job file %s: %v", path, err)
+			continue
+		}
+
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil || job.ID == "" {
+			log.Printf("Skipping invalid job file %s: %v", path, err)
+			continue
+		}
+
+		if job.Finished() && time.Since(job.UpdatedAt) > retention {
+			os.Remove(path)
+			continue
+		}
+
+		if !job.Finished() || job.replicating() {
+			if !job.Finished() {
+				job.State = JobFailed
+				job.Error = "interrupted by server restart"
+			}
+			for _, replica := range job.Replicas {
+				if !replica.finished() {
+					replica.State = JobFailed
+					replica.Error = "interrupted by server restart"
+				}
+			}
+			job.UpdatedAt = time.Now()
+			if err := store.save(&job); err != nil {
+				log.Printf("Failed to persist job %s: %v", job.ID, err)
+			}
+		}
+
+		store.jobs[job.ID] = &job
+	}
+
+	log.Printf("Loaded %d jobs from %s", len(store.jobs), dir)
+	return store, nil
+}
+
+// save writes a job to disk atomically. Callers must hold s.mu or own the job exclusively.
+func (s *JobStore) save(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, job.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.saved[job.ID] = time.Now()
+	return nil
+}
+
+// Create adds a new job to the store
+func (s *JobStore) Create(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	s.jobs[job.ID] = job
+	return s.save(job)
+}
+
+// Update applies fn to the job with the given ID and persists the result
+func (s *JobStore) Update(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+
+	fn(job)
+	job.UpdatedAt = time.Now()
+	if err := s.save(job); err != nil {
+		log.Printf("Failed to persist job %s: %v", id, err)
+	}
+}
+
+// UpdateProgress applies fn to the job like Update, but writes it to disk at most once per
+// jobProgressInterval. It is meant for progress callbacks; the job's next Update writes
+// anything skipped here.
+func (s *JobStore) UpdateProgress(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+
+	fn(job)
+	job.UpdatedAt = time.Now()
+	if time.Since(s.saved[id]) < jobProgressInterval {
+		return
+	}
+	if err := s.save(job); err != nil {
+		log.Printf("Failed to persist job %s: %v", id, err)
+	}
+}
+
+// Get returns a copy of the job with the given ID
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// List returns up to limit jobs, most recent first
+func (s *JobStore) List(limit int) []Job {
+	s.mu.Lock()
+	list := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		list = append(list, job.snapshot())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+var (
+	jobStore     *JobStore
+	jobStoreErr  error
+	jobStoreOnce sync.Once
+)
+
+// getJobStore opens the shared job store on first use.
+// The directory is taken from JOBS_DIR and defaults to a folder in the system temp directory,
+// which is often cleared on reboot, so deployments should point JOBS_DIR at persistent storage.
+func getJobStore() (*JobStore, error) {
+	jobStoreOnce.Do(func() {
+		dir := config.GetEnvWithDefault("JOBS_DIR", "")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "ksau-jobs")
+			log.Printf("JOBS_DIR is not set, keeping jobs in %s; they may not survive a reboot", dir)
+		}
+		retention := config.GetEnvDurationWithDefault("JOBS_RETENTION", defaultJobRetention)
+		jobStore, jobStoreErr = NewJobStore(dir, retention)
+	})
+	return jobStore, jobStoreErr
+}
+
+// JobsHandler serves GET /jobs/{id} and, with the admin token, GET /jobs
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	store, err := getJobStore()
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Job store unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	id := strings.TrimSpace(r.PathValue("id"))
+	if id != "" {
+		job, ok := store.Get(id)
+		if !ok {
+			sendErrorResponse(w, http.StatusNotFound, fmt.Errorf("job %s not found", id), "Job not found")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   job,
+		})
+		return
+	}
+
+	// The list shows every client's jobs, with their source URLs and sharing links
+	if !checkAdmin(w, r) {
+		return
+	}
+
+	limit := defaultJobListLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", limitStr), "Invalid request")
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   store.List(limit),
+	})
+}
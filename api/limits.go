@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// defaultUploadQueueSize is how many uploads per remote may wait for a worker
+	defaultUploadQueueSize = 16
+	// defaultQueueRetryAfter is suggested to clients rejected because the queue is full
+	defaultQueueRetryAfter = 30 * time.Second
+)
+
+// errUploadQueueFull is returned when no worker is free for a remote and its queue is full
+var errUploadQueueFull = errors.New("upload queue is full")
+
+// remoteLimits holds the bandwidth and concurrency limits of one remote
+type remoteLimits struct {
+	send          *azure.RateLimiter // data sent to OneDrive
+	receive       *azure.RateLimiter // request bodies received from clients
+	maxConcurrent int                // uploads running at once, 0 for unlimited
+	queueSize     int                // uploads waiting for a worker
+}
+
+var (
+	globalSendLimiter    *azure.RateLimiter
+	globalReceiveLimiter *azure.RateLimiter
+	limitsByRemote       map[string]*remoteLimits
+	queueRetryAfter      time.Duration
+	limitsOnce           sync.Once
+)
+
+// loadLimits reads the limits from the environment:
+//
+//	UPLOAD_BANDWIDTH_LIMIT         bytes per second across all remotes, e.g. 20M
+//	REMOTE_BANDWIDTH_LIMITS        per remote bytes per second, e.g. oned=5M,saurajcf=10M
+//	MAX_CONCURRENT_UPLOADS         uploads per remote running at once, 0 for unlimited
+//	REMOTE_MAX_CONCURRENT_UPLOADS  per remote override, e.g. oned=2
+//	UPLOAD_QUEUE_SIZE              uploads per remote waiting for a worker
+//	UPLOAD_QUEUE_RETRY_AFTER       Retry-After sent when the queue is full
+func loadLimits() {
+	if limit := config.GetEnvSizeWithDefault("UPLOAD_BANDWIDTH_LIMIT", 0); limit > 0 {
+		globalSendLimiter = azure.NewRateLimiter(limit)
+		globalReceiveLimiter = azure.NewRateLimiter(limit)
+		log.Printf("Upload bandwidth limited to %d bytes/s", limit)
+	}
+
+	bandwidth := config.GetEnvMap("REMOTE_BANDWIDTH_LIMITS")
+	concurrency := config.GetEnvMap("REMOTE_MAX_CONCURRENT_UPLOADS")
+	defaultConcurrency := config.GetEnvIntWithDefault("MAX_CONCURRENT_UPLOADS", 0)
+	queueSize := config.GetEnvIntWithDefault("UPLOAD_QUEUE_SIZE", defaultUploadQueueSize)
+	queueRetryAfter = config.GetEnvDurationWithDefault("UPLOAD_QUEUE_RETRY_AFTER", defaultQueueRetryAfter)
+
+	limitsByRemote = make(map[string]*remoteLimits, len(rootFolders))
+	for remote := range rootFolders {
+		limits := &remoteLimits{queueSize: queueSize}
+
+		if value, ok := bandwidth[remote]; ok {
+			limit, err := config.ParseByteSize(value)
+			if err != nil {
+				log.Printf("Ignoring bandwidth limit for %s: %v", remote, err)
+			} else if limit > 0 {
+				limits.send = azure.NewRateLimiter(limit)
+				limits.receive = azure.NewRateLimiter(limit)
+				log.Printf("Upload bandwidth for %s limited to %d bytes/s", remote, limit)
+			}
+		}
+
+		limits.maxConcurrent = defaultConcurrency
+		if value, ok := concurrency[remote]; ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				log.Printf("Ignoring concurrent upload limit for %s: %v", remote, err)
+			} else {
+				limits.maxConcurrent = n
+			}
+		}
+		if limits.maxConcurrent > 0 {
+			log.Printf("Concurrent uploads to %s limited to %d", remote, limits.maxConcurrent)
+		}
+
+		limitsByRemote[remote] = limits
+	}
+}
+
+// getRemoteLimits returns the limits for remote
+func getRemoteLimits(remote string) *remoteLimits {
+	limitsOnce.Do(loadLimits)
+	if limits, ok := limitsByRemote[remote]; ok {
+		return limits
+	}
+	return &remoteLimits{queueSize: defaultUploadQueueSize}
+}
+
+// sendLimiters returns the limiters for data sent to OneDrive
+func (l *remoteLimits) sendLimiters() []*azure.RateLimiter {
+	return []*azure.RateLimiter{globalSendLimiter, l.send}
+}
+
+// receiveLimiters returns the limiters for data received from clients
+func (l *remoteLimits) receiveLimiters() []*azure.RateLimiter {
+	return []*azure.RateLimiter{globalReceiveLimiter, l.receive}
+}
+
+// newRemoteClient creates an AzureClient for remote whose uploads honor the remote's bandwidth limits
+func newRemoteClient(remote string) (*azure.AzureClient, error) {
+	client, err := azure.NewAzureClientFromRcloneConfigData(config.GetRcloneConfig(), remote)
+	if err != nil {
+		return nil, err
+	}
+	for _, limiter := range getRemoteLimits(remote).sendLimiters() {
+		if limiter != nil {
+			client.UploadLimiters = append(client.UploadLimiters, limiter)
+		}
+	}
+	return client, nil
+}
+
+// waitForTurn waits for a queued upload's worker, showing it as queued meanwhile,
+// and then moves the tracker on to next
+func waitForTurn(ctx context.Context, ticket *uploadTicket, tracker *ProgressTracker, next ProgressPhase) error {
+	if ticket.granted() {
+		return nil
+	}
+
+	tracker.SetPhase(PhaseQueued)
+	if err := ticket.wait(ctx); err != nil {
+		return err
+	}
+	tracker.SetPhase(next)
+	return nil
+}
+
+// waitForJobTurn waits for a queued job's worker, recording the wait in the job store,
+// and then moves the job on to state and its tracker to phase.
+// A job cancelled while queued is marked as such and an error is returned.
+func waitForJobTurn(ctx context.Context, store *JobStore, jobID string, ticket *uploadTicket, tracker *ProgressTracker, phase ProgressPhase, state JobState) error {
+	if ticket.granted() {
+		return nil
+	}
+
+	store.Update(jobID, func(job *Job) {
+		job.State = JobQueued
+	})
+	if err := waitForTurn(ctx, ticket, tracker, phase); err != nil {
+		err = cancellationError(ctx, err)
+		failJob(store, jobID, err)
+		tracker.Finish(err)
+		return err
+	}
+	store.Update(jobID, func(job *Job) {
+		job.State = state
+	})
+	return nil
+}
+
+// retryAfterHeader formats d as a Retry-After value in whole seconds
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
@@ -0,0 +1,534 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// defaultListLimit is the number of items in a page of GET /list
+	defaultListLimit = 200
+	// maxListLimit caps the limit parameter, and is the page size asked of Graph
+	maxListLimit = 1000
+	// defaultMaxListItems caps the items fetched by sorted and recursive listings
+	defaultMaxListItems = 10000
+	// maxListDepth caps the depth of recursive listings
+	maxListDepth = 10
+	// maxListPages is how many Graph pages a filtered listing reads before returning
+	// a short page, so sparse matches in a huge folder do not hold up one request
+	maxListPages = 10
+)
+
+// MaxListItems returns the most items a sorted or recursive listing fetches
+func MaxListItems() int {
+	return config.GetEnvIntWithDefault("LIST_MAX_ITEMS", defaultMaxListItems)
+}
+
+// listFilter selects the files of a listing. Folders only match when no filter is set.
+type listFilter struct {
+	Extensions []string // lower case, without the dot
+	MimeTypes  []string // lower case; a trailing /* matches the whole type
+	MinSize    int64
+	MaxSize    int64 // -1 for no limit
+}
+
+// active reports whether any filter is set
+func (f *listFilter) active() bool {
+	return len(f.Extensions) > 0 || len(f.MimeTypes) > 0 || f.MinSize > 0 || f.MaxSize >= 0
+}
+
+// match reports whether item passes the filter
+func (f *listFilter) match(item *azure.DriveItem) bool {
+	if item.Folder != nil {
+		return !f.active()
+	}
+	if item.Size < f.MinSize || (f.MaxSize >= 0 && item.Size > f.MaxSize) {
+		return false
+	}
+
+	if len(f.Extensions) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(item.Name), "."))
+		found := false
+		for _, want := range f.Extensions {
+			if ext == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.MimeTypes) > 0 {
+		var mimeType string
+		if item.File != nil {
+			mimeType = strings.ToLower(item.File.MimeType)
+		}
+		found := false
+		for _, want := range f.MimeTypes {
+			if prefix, ok := strings.CutSuffix(want, "*"); ok && strings.HasPrefix(mimeType, prefix) || mimeType == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// listOptions are the query parameters of GET /list
+type listOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string // name, size or modified; empty keeps Graph's order
+	Desc   bool
+	Filter listFilter
+	Depth  int  // 1 lists the folder's children only
+	Tree   bool // nest the children of folders instead of returning a flat list
+}
+
+// recursive reports whether the listing descends into subfolders
+func (opts *listOptions) recursive() bool {
+	return opts.Tree || opts.Depth > 1
+}
+
+// splitList splits a comma separated parameter into lower case values
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseListOptions reads the listing options from the query string
+func parseListOptions(query url.Values) (*listOptions, error) {
+	opts := &listOptions{
+		Limit:  defaultListLimit,
+		Cursor: query.Get("cursor"),
+		Depth:  1,
+		Filter: listFilter{MaxSize: -1},
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return nil, fmt.Errorf("invalid limit: %s (must be 1 to %d)", value, maxListLimit)
+		}
+		opts.Limit = limit
+	}
+
+	switch sortBy := query.Get("sort"); sortBy {
+	case "", "name", "size", "modified":
+		opts.Sort = sortBy
+	default:
+		return nil, fmt.Errorf("invalid sort: %s (must be name, size or modified)", sortBy)
+	}
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return nil, fmt.Errorf("invalid order: %s (must be asc or desc)", order)
+	}
+	if opts.Desc && opts.Sort == "" {
+		return nil, fmt.Errorf("order requires sort")
+	}
+
+	for _, ext := range splitList(query.Get("ext")) {
+		opts.Filter.Extensions = append(opts.Filter.Extensions, strings.TrimPrefix(ext, "."))
+	}
+	opts.Filter.MimeTypes = splitList(query.Get("mime"))
+	if value := query.Get("minSize"); value != "" {
+		size, err := config.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minSize: %v", err)
+		}
+		opts.Filter.MinSize = size
+	}
+	if value := query.Get("maxSize"); value != "" {
+		size, err := config.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxSize: %v", err)
+		}
+		opts.Filter.MaxSize = size
+	}
+	if opts.Filter.MaxSize >= 0 && opts.Filter.MinSize > opts.Filter.MaxSize {
+		return nil, fmt.Errorf("minSize is larger than maxSize")
+	}
+
+	if value := query.Get("depth"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 || depth > maxListDepth {
+			return nil, fmt.Errorf("invalid depth: %s (must be 1 to %d)", value, maxListDepth)
+		}
+		opts.Depth = depth
+	}
+	if value := query.Get("tree"); value != "" {
+		tree, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree: %s", value)
+		}
+		opts.Tree = tree
+	}
+	if opts.Cursor != "" && opts.recursive() {
+		return nil, fmt.Errorf("recursive listings are not paginated")
+	}
+	return opts, nil
+}
+
+// listCursor is the position of the next page of a listing. Clients get it base64 encoded
+// and must not rely on its contents.
+type listCursor struct {
+	Query  string `json:"q"`           // fingerprint of the listing it belongs to
+	Token  string `json:"t,omitempty"` // Graph $skiptoken of the page to continue from; empty is the first
+	Skip   int    `json:"s,omitempty"` // items of that page already returned
+	Offset int    `json:"o,omitempty"` // sorted listings: items already returned
+}
+
+// listFingerprint identifies a listing, so a cursor is only accepted by the listing it came from.
+// The limit is part of it since it is also the page size asked of Graph, which skip tokens depend on.
+func listFingerprint(remote, relPath string, opts *listOptions) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%t\x00%q\x00%q\x00%d\x00%d",
+		remote, relPath, opts.Limit, opts.Sort, opts.Desc, opts.Filter.Extensions, opts.Filter.MimeTypes, opts.Filter.MinSize, opts.Filter.MaxSize)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encode returns the cursor as sent to clients
+func (c *listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListCursor parses a cursor of the listing identified by query; an empty value is
+// the start of the listing
+func decodeListCursor(value, query string) (*listCursor, error) {
+	if value == "" {
+		return &listCursor{Query: query}, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Skip < 0 || cursor.Offset < 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cursor.Query != query {
+		return nil, fmt.Errorf("cursor belongs to a different listing")
+	}
+	return &cursor, nil
+}
+
+// sortItems orders items by opts.Sort, breaking ties by name
+func sortItems(items []azure.DriveItem, opts *listOptions) {
+	if opts.Sort == "" {
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := &items[i], &items[j]
+		if opts.Desc {
+			a, b = b, a
+		}
+		switch opts.Sort {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.LastModifiedDateTime.Equal(b.LastModifiedDateTime) {
+				return a.LastModifiedDateTime.Before(b.LastModifiedDateTime)
+			}
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// listAll fetches every child of the folder at relPath, up to budget items in total across a
+// listing. It reports whether children were left out because the budget ran out.
+func listAll(ctx context.Context, client *azure.AzureClient, remote, relPath string, budget *int) ([]azure.DriveItem, bool, error) {
+	var items []azure.DriveItem
+	var skipToken string
+	for {
+		page, err := client.ListChildren(ctx, http.DefaultClient, remoteItemPath(remote, relPath), skipToken, maxListLimit)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(page.Items) > *budget {
+			items = append(items, page.Items[:*budget]...)
+			*budget = 0
+			return items, true, nil
+		}
+		items = append(items, page.Items...)
+		*budget -= len(page.Items)
+
+		if page.NextLink == "" {
+			return items, false, nil
+		}
+		if *budget == 0 {
+			return items, true, nil
+		}
+		skipToken = page.SkipToken
+	}
+}
+
+// listing is the result of GET /list
+type listing struct {
+	Path       string     `json:"path"`
+	Items      []fileInfo `json:"items"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	Truncated  bool       `json:"truncated,omitempty"` // recursive listings that hit the item limit
+}
+
+// listPage returns a page of a folder's children in Graph's order, following Graph's pages
+// until the page is full
+func listPage(ctx context.Context, client *azure.AzureClient, remote, relPath string, opts *listOptions, cursor *listCursor) (*listing, error) {
+	result := &listing{Path: relPath, Items: []fileInfo{}}
+
+	// Unfiltered pages map onto Graph's; filtered ones read as much as Graph allows at once
+	pageSize := opts.Limit
+	if opts.Filter.active() {
+		pageSize = maxListLimit
+	}
+
+	skipToken, skip := cursor.Token, cursor.Skip
+	for pages := 0; pages < maxListPages; pages++ {
+		page, err := client.ListChildren(ctx, http.DefaultClient, remoteItemPath(remote, relPath), skipToken, pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := min(skip, len(page.Items)); i < len(page.Items); i++ {
+			item := &page.Items[i]
+			if !opts.Filter.match(item) {
+				continue
+			}
+			result.Items = append(result.Items, newFileInfo(remote, filepath.Join(relPath, item.Name), item))
+			if len(result.Items) < opts.Limit {
+				continue
+			}
+
+			// Page full: continue after this item, or with Graph's next page
+			next := &listCursor{Query: cursor.Query, Token: skipToken, Skip: i + 1}
+			if i+1 == len(page.Items) {
+				if page.NextLink == "" {
+					return result, nil
+				}
+				next = &listCursor{Query: cursor.Query, Token: page.SkipToken}
+			}
+			result.NextCursor = next.encode()
+			return result, nil
+		}
+
+		if page.NextLink == "" {
+			return result, nil
+		}
+		skipToken, skip = page.SkipToken, 0
+	}
+
+	result.NextCursor = (&listCursor{Query: cursor.Query, Token: skipToken}).encode()
+	return result, nil
+}
+
+// listSorted returns a page of a folder's sorted children. Graph cannot sort every drive,
+// so the whole folder is fetched and sorted for each page.
+func listSorted(ctx context.Context, client *azure.AzureClient, remote, relPath string, opts *listOptions, cursor *listCursor) (*listing, int, error) {
+	budget := MaxListItems()
+	items, truncated, err := listAll(ctx, client, remote, relPath, &budget)
+	if err != nil {
+		return nil, graphErrorStatus(err), err
+	}
+	if truncated {
+		return nil, http.StatusBadRequest, fmt.Errorf("folder has more than %d items and cannot be sorted; list it without sort", MaxListItems())
+	}
+
+	matched := items[:0]
+	for i := range items {
+		if opts.Filter.match(&items[i]) {
+			matched = append(matched, items[i])
+		}
+	}
+	sortItems(matched, opts)
+
+	result := &listing{Path: relPath, Items: []fileInfo{}}
+	start := min(cursor.Offset, len(matched))
+	end := min(start+opts.Limit, len(matched))
+	for i := start; i < end; i++ {
+		result.Items = append(result.Items, newFileInfo(remote, filepath.Join(relPath, matched[i].Name), &matched[i]))
+	}
+	if end < len(matched) {
+		result.NextCursor = (&listCursor{Query: cursor.Query, Offset: end}).encode()
+	}
+	return result, 0, nil
+}
+
+// listTree lists the folder at relPath and its subfolders down to depth levels, nesting
+// children under their folders in tree mode and flattening them otherwise. budget caps the
+// number of items fetched.
+func listTree(ctx context.Context, client *azure.AzureClient, remote, relPath string, depth int, opts *listOptions, budget *int) ([]fileInfo, bool, error) {
+	items, truncated, err := listAll(ctx, client, remote, relPath, budget)
+	if err != nil {
+		return nil, false, err
+	}
+	sortItems(items, opts)
+
+	result := []fileInfo{}
+	for i := range items {
+		item := &items[i]
+		itemPath := filepath.Join(relPath, item.Name)
+		isFolder := item.Folder != nil
+
+		var children []fileInfo
+		if isFolder && depth > 1 && *budget > 0 {
+			var childTruncated bool
+			children, childTruncated, err = listTree(ctx, client, remote, itemPath, depth-1, opts, budget)
+			if err != nil {
+				return nil, false, err
+			}
+			truncated = truncated || childTruncated
+		} else if isFolder && depth > 1 {
+			truncated = true
+		}
+
+		switch {
+		case opts.Tree && isFolder:
+			// Folders hold the tree together even when a filter leaves them out
+			info := newFileInfo(remote, itemPath, item)
+			info.Children = children
+			result = append(result, info)
+		case opts.Tree:
+			if opts.Filter.match(item) {
+				result = append(result, newFileInfo(remote, itemPath, item))
+			}
+		default:
+			if opts.Filter.match(item) {
+				result = append(result, newFileInfo(remote, itemPath, item))
+			}
+			result = append(result, children...)
+		}
+	}
+	return result, truncated, nil
+}
+
+// sortInfos orders a flattened listing the way sortItems orders a folder
+func sortInfos(infos []fileInfo, opts *listOptions) {
+	if opts.Sort == "" {
+		return
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		a, b := &infos[i], &infos[j]
+		if opts.Desc {
+			a, b = b, a
+		}
+		switch opts.Sort {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.ModifiedAt.Equal(b.ModifiedAt) {
+				return a.ModifiedAt.Before(b.ModifiedAt)
+			}
+		}
+		return strings.ToLower(a.Path) < strings.ToLower(b.Path)
+	})
+}
+
+// ListHandler handles GET /list/{remote}/{path}, which lists the children of a folder page by
+// page with optional sorting and filtering, or recursively as a flat list or a tree
+func ListHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	remote := r.PathValue("remote")
+	if _, ok := rootFolders[remote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+	relPath := cleanRemotePath(r.PathValue("path"))
+
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+	cursor, err := decodeListCursor(opts.Cursor, listFingerprint(remote, relPath, opts))
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+
+	client, err := openRemote(r.Context(), remote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	var result *listing
+	switch {
+	case opts.recursive():
+		budget := MaxListItems()
+		items, truncated, err := listTree(r.Context(), client, remote, relPath, opts.Depth, opts, &budget)
+		if err != nil {
+			sendErrorResponse(w, graphErrorStatus(err), err, "Failed to list folder")
+			return
+		}
+		if !opts.Tree {
+			// Flat listings are sorted as a whole rather than folder by folder
+			sortInfos(items, opts)
+		}
+		result = &listing{Path: relPath, Items: items, Truncated: truncated}
+	case opts.Sort != "":
+		var status int
+		result, status, err = listSorted(r.Context(), client, remote, relPath, opts, cursor)
+		if err != nil {
+			sendErrorResponse(w, status, err, "Failed to list folder")
+			return
+		}
+	default:
+		result, err = listPage(r.Context(), client, remote, relPath, opts, cursor)
+		if err != nil {
+			sendErrorResponse(w, graphErrorStatus(err), err, "Failed to list folder")
+			return
+		}
+	}
+
+	log.Printf("Listed %d items of %s on %s", len(result.Items), relPath, remote)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   result,
+	})
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+func TestParseListOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    *listOptions
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			query: "",
+			want:  &listOptions{Limit: defaultListLimit, Depth: 1, Filter: listFilter{MaxSize: -1}},
+		},
+		{
+			name:  "sorted page",
+			query: "limit=50&sort=size&order=desc&cursor=abc",
+			want:  &listOptions{Limit: 50, Cursor: "abc", Sort: "size", Desc: true, Depth: 1, Filter: listFilter{MaxSize: -1}},
+		},
+		{
+			name:  "filters",
+			query: "ext=.JPG,+png,,&mime=image/*,Video/MP4&minSize=1K&maxSize=1.5M",
+			want: &listOptions{Limit: defaultListLimit, Depth: 1, Filter: listFilter{
+				Extensions: []string{"jpg", "png"},
+				MimeTypes:  []string{"image/*", "video/mp4"},
+				MinSize:    1 << 10,
+				MaxSize:    3 << 19,
+			}},
+		},
+		{
+			name:  "recursive",
+			query: "depth=3&tree=true",
+			want:  &listOptions{Limit: defaultListLimit, Depth: 3, Tree: true, Filter: listFilter{MaxSize: -1}},
+		},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "limit too large", query: "limit=1001", wantErr: true},
+		{name: "limit not a number", query: "limit=ten", wantErr: true},
+		{name: "unknown sort", query: "sort=type", wantErr: true},
+		{name: "unknown order", query: "sort=name&order=up", wantErr: true},
+		{name: "order without sort", query: "order=desc", wantErr: true},
+		{name: "invalid minSize", query: "minSize=big", wantErr: true},
+		{name: "minSize above maxSize", query: "minSize=2M&maxSize=1M", wantErr: true},
+		{name: "depth too deep", query: "depth=11", wantErr: true},
+		{name: "invalid tree", query: "tree=maybe", wantErr: true},
+		{name: "cursor on a recursive listing", query: "depth=2&cursor=abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("invalid test query %q: %v", tt.query, err)
+			}
+			got, err := parseListOptions(query)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseListOptions(%q) = %+v, want an error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseListOptions(%q) failed: %v", tt.query, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseListOptions(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeListCursor(t *testing.T) {
+	cursor := &listCursor{Query: "q1", Token: "tok", Skip: 3}
+
+	tests := []struct {
+		name    string
+		value   string
+		query   string
+		want    *listCursor
+		wantErr bool
+	}{
+		{name: "empty starts the listing", value: "", query: "q1", want: &listCursor{Query: "q1"}},
+		{name: "round trip", value: cursor.encode(), query: "q1", want: cursor},
+		{name: "other listing", value: cursor.encode(), query: "q2", wantErr: true},
+		{name: "not base64", value: "!!!", query: "q1", wantErr: true},
+		{name: "not json", value: "bm90IGpzb24", query: "q1", wantErr: true},
+		{name: "negative skip", value: (&listCursor{Query: "q1", Skip: -1}).encode(), query: "q1", wantErr: true},
+		{name: "negative offset", value: (&listCursor{Query: "q1", Offset: -1}).encode(), query: "q1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeListCursor(tt.value, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("decodeListCursor(%q) = %+v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeListCursor(%q) failed: %v", tt.value, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeListCursor(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFingerprint(t *testing.T) {
+	opts := &listOptions{Limit: 100, Sort: "name"}
+	base := listFingerprint("oned", "docs", opts)
+	if got := listFingerprint("oned", "docs", &listOptions{Limit: 100, Sort: "name"}); got != base {
+		t.Errorf("same listing has fingerprints %s and %s", base, got)
+	}
+
+	others := map[string]*listOptions{
+		"limit": {Limit: 50, Sort: "name"},
+		"sort":  {Limit: 100, Sort: "size"},
+		"order": {Limit: 100, Sort: "name", Desc: true},
+	}
+	for name, other := range others {
+		if listFingerprint("oned", "docs", other) == base {
+			t.Errorf("listing with another %s has the same fingerprint", name)
+		}
+	}
+}
+
+func TestListFilterMatch(t *testing.T) {
+	file := func(name, mimeType string, size int64) *azure.DriveItem {
+		return &azure.DriveItem{Name: name, Size: size, File: &azure.FileFacet{MimeType: mimeType}}
+	}
+	folder := &azure.DriveItem{Name: "photos", Folder: &azure.FolderFacet{}}
+
+	tests := []struct {
+		name   string
+		filter listFilter
+		item   *azure.DriveItem
+		want   bool
+	}{
+		{"no filter matches files", listFilter{MaxSize: -1}, file("a.txt", "text/plain", 10), true},
+		{"no filter matches folders", listFilter{MaxSize: -1}, folder, true},
+		{"filter hides folders", listFilter{Extensions: []string{"jpg"}, MaxSize: -1}, folder, false},
+		{"extension", listFilter{Extensions: []string{"png", "jpg"}, MaxSize: -1}, file("IMG.JPG", "image/jpeg", 10), true},
+		{"other extension", listFilter{Extensions: []string{"png"}, MaxSize: -1}, file("img.jpg", "image/jpeg", 10), false},
+		{"no extension", listFilter{Extensions: []string{"jpg"}, MaxSize: -1}, file("README", "text/plain", 10), false},
+		{"mime type", listFilter{MimeTypes: []string{"image/jpeg"}, MaxSize: -1}, file("a.jpg", "Image/JPEG", 10), true},
+		{"mime wildcard", listFilter{MimeTypes: []string{"image/*"}, MaxSize: -1}, file("a.png", "image/png", 10), true},
+		{"other mime type", listFilter{MimeTypes: []string{"image/*"}, MaxSize: -1}, file("a.mp4", "video/mp4", 10), false},
+		{"no file facet", listFilter{MimeTypes: []string{"image/*"}, MaxSize: -1}, &azure.DriveItem{Name: "a.png"}, false},
+		{"at minSize", listFilter{MinSize: 10, MaxSize: -1}, file("a.txt", "text/plain", 10), true},
+		{"below minSize", listFilter{MinSize: 11, MaxSize: -1}, file("a.txt", "text/plain", 10), false},
+		{"at maxSize", listFilter{MaxSize: 10}, file("a.txt", "text/plain", 10), true},
+		{"above maxSize", listFilter{MaxSize: 9}, file("a.txt", "text/plain", 10), false},
+		{"zero maxSize", listFilter{MaxSize: 0}, file("empty", "text/plain", 0), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.match(tt.item); got != tt.want {
+				t.Errorf("match(%s) = %t, want %t", tt.item.Name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// ProgressPhase is the stage an upload is in
+type ProgressPhase string
+
+// Progress phases
+const (
+	PhasePending   ProgressPhase = "pending"
+	PhaseQueued    ProgressPhase = "queued"
+	PhaseReceiving ProgressPhase = "receiving"
+	PhaseUploading ProgressPhase = "uploading"
+	PhaseDone      ProgressPhase = "done"
+	PhaseFailed    ProgressPhase = "failed"
+	PhaseCancelled ProgressPhase = "cancelled"
+)
+
+// Finished reports whether the phase is a terminal one
+func (phase ProgressPhase) Finished() bool {
+	return phase == PhaseDone || phase == PhaseFailed || phase == PhaseCancelled
+}
+
+const (
+	// progressNotifyInterval throttles how often subscribers are notified
+	progressNotifyInterval = 250 * time.Millisecond
+	// progressRetention is how long finished or unclaimed trackers remain queryable
+	progressRetention = 2 * time.Minute
+	// sseKeepAliveInterval is how often an idle event stream receives a comment line
+	sseKeepAliveInterval = 15 * time.Second
+)
+
+// uploadIDPattern restricts client supplied upload IDs
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ProgressSnapshot is the state of an upload at a point in time
+type ProgressSnapshot struct {
+	ID            string        `json:"id"`
+	Phase         ProgressPhase `json:"phase"`
+	Percent       float64       `json:"percent"`
+	TotalBytes    int64         `json:"totalBytes"`
+	BytesReceived int64         `json:"bytesReceived"`
+	BytesSent     int64         `json:"bytesSent"`
+	Throughput    float64       `json:"throughput"` // bytes per second in the current phase
+	ETA           float64       `json:"eta"`        // seconds, -1 if unknown
+	Chunk         int           `json:"chunk"`
+	Chunks        int           `json:"chunks"`
+	Retries       int           `json:"retries"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// ProgressTracker follows an upload through the receive and OneDrive phases
+// and broadcasts snapshots to its subscribers
+type ProgressTracker struct {
+	mu          sync.Mutex
+	id          string
+	phase       ProgressPhase
+	total       int64
+	received    int64
+	sent        int64
+	chunk       int
+	chunks      int
+	retries     int
+	err         string
+	phaseStart  time.Time
+	phaseOffset int64
+	lastNotify  time.Time
+	subscribers map[chan ProgressSnapshot]struct{}
+	cancel      context.CancelFunc // aborts the upload, set while it can be cancelled
+	cancelToken string             // authorizes DELETE /uploads/{id} for the uploader
+}
+
+var (
+	progressTrackers   = make(map[string]*ProgressTracker)
+	progressTrackersMu sync.Mutex
+)
+
+// newUploadID validates a client supplied upload ID or generates one
+func newUploadID(requested string) (string, error) {
+	if requested == "" {
+		return newID()
+	}
+	if !uploadIDPattern.MatchString(requested) {
+		return "", fmt.Errorf("invalid upload ID: must be 1-64 characters of letters, digits, '-' or '_'")
+	}
+	return requested, nil
+}
+
+// acquireProgressTracker registers a tracker for a new upload. A pending tracker
+// created by an early subscriber is adopted; an active one is an error.
+func acquireProgressTracker(id string, total int64) (*ProgressTracker, error) {
+	cancelToken, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	progressTrackersMu.Lock()
+	defer progressTrackersMu.Unlock()
+
+	if tracker, ok := progressTrackers[id]; ok {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		switch tracker.phase {
+		case PhasePending:
+			tracker.total = total
+			tracker.cancelToken = cancelToken
+			tracker.setPhase(PhaseReceiving)
+			return tracker, nil
+		case PhaseQueued, PhaseReceiving, PhaseUploading:
+			return nil, fmt.Errorf("upload %s is already in progress", id)
+		}
+		// A finished upload's ID may be reused
+	}
+
+	tracker := &ProgressTracker{
+		id:          id,
+		total:       total,
+		subscribers: make(map[chan ProgressSnapshot]struct{}),
+		cancelToken: cancelToken,
+	}
+	tracker.setPhase(PhaseReceiving)
+	progressTrackers[id] = tracker
+	return tracker, nil
+}
+
+// watchProgressTracker returns the tracker for id, creating a pending one so
+// clients can subscribe before the upload request arrives
+func watchProgressTracker(id string) *ProgressTracker {
+	progressTrackersMu.Lock()
+	defer progressTrackersMu.Unlock()
+
+	if tracker, ok := progressTrackers[id]; ok {
+		return tracker
+	}
+
+	tracker := &ProgressTracker{
+		id:          id,
+		phase:       PhasePending,
+		subscribers: make(map[chan ProgressSnapshot]struct{}),
+	}
+	progressTrackers[id] = tracker
+	scheduleTrackerRemoval(tracker, PhasePending)
+	return tracker
+}
+
+// scheduleTrackerRemoval drops a tracker after progressRetention if it is still in the given phase
+func scheduleTrackerRemoval(tracker *ProgressTracker, phase ProgressPhase) {
+	time.AfterFunc(progressRetention, func() {
+		tracker.mu.Lock()
+		current := tracker.phase
+		tracker.mu.Unlock()
+		if current != phase {
+			return
+		}
+
+		progressTrackersMu.Lock()
+		if progressTrackers[tracker.id] == tracker {
+			delete(progressTrackers, tracker.id)
+		}
+		progressTrackersMu.Unlock()
+	})
+}
+
+// setPhase switches phase and restarts the throughput measurement. Callers must hold t.mu.
+func (t *ProgressTracker) setPhase(phase ProgressPhase) {
+	t.phase = phase
+	t.phaseStart = time.Now()
+	switch phase {
+	case PhaseReceiving:
+		t.phaseOffset = t.received
+	case PhaseUploading:
+		t.phaseOffset = t.sent
+	}
+	t.notify(true)
+}
+
+// SetPhase moves the tracker into a new phase
+func (t *ProgressTracker) SetPhase(phase ProgressPhase) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setPhase(phase)
+}
+
+// SetTotal updates the expected size once it is known
+func (t *ProgressTracker) SetTotal(total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total = total
+}
+
+// SetCancel registers the function that aborts the upload
+func (t *ProgressTracker) SetCancel(cancel context.CancelFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancel = cancel
+}
+
+// Cancel aborts an active upload. The upload itself reports the outcome through Finish.
+func (t *ProgressTracker) Cancel() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.phase.Finished() {
+		return fmt.Errorf("upload %s already %s", t.id, t.phase)
+	}
+	if t.cancel == nil {
+		return fmt.Errorf("upload %s cannot be cancelled", t.id)
+	}
+	t.cancel()
+	return nil
+}
+
+// CancelToken returns the secret that lets the uploader cancel the upload
+func (t *ProgressTracker) CancelToken() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancelToken
+}
+
+// checkCancel reports whether r may cancel the tracker's upload, writing an error response if not.
+// The uploader authorizes with the job's cancel token in X-Cancel-Token, anyone else needs the admin token.
+func (t *ProgressTracker) checkCancel(w http.ResponseWriter, r *http.Request) bool {
+	provided := r.Header.Get("X-Cancel-Token")
+	if provided == "" {
+		return checkAdmin(w, r)
+	}
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(t.CancelToken())) != 1 {
+		sendErrorResponse(w, http.StatusUnauthorized, fmt.Errorf("invalid cancel token"), "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// Write records bytes received from the client, so the tracker can be used with io.TeeReader
+func (t *ProgressTracker) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.received += int64(len(p))
+	t.notify(false)
+	return len(p), nil
+}
+
+// UploadProgress records the chunk progress reported by azure.AzureClient
+func (t *ProgressTracker) UploadProgress(progress azure.UploadProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = progress.BytesSent
+	t.chunk = progress.Chunk
+	t.chunks = progress.Chunks
+	t.retries = progress.Retries
+	t.notify(true)
+}
+
+// Finish marks the upload as done or failed and closes all subscriptions
+func (t *ProgressTracker) Finish(err error) {
+	t.mu.Lock()
+	t.cancel = nil
+	if errors.Is(err, context.Canceled) {
+		t.err = err.Error()
+		t.phase = PhaseCancelled
+	} else if err != nil {
+		t.err = err.Error()
+		t.phase = PhaseFailed
+	} else {
+		t.phase = PhaseDone
+		if t.sent < t.total {
+			t.sent = t.total
+		}
+	}
+	t.notify(true)
+	for ch := range t.subscribers {
+		close(ch)
+		delete(t.subscribers, ch)
+	}
+	phase := t.phase
+	t.mu.Unlock()
+
+	scheduleTrackerRemoval(t, phase)
+}
+
+// Subscribe returns a channel receiving snapshots until the upload finishes
+func (t *ProgressTracker) Subscribe() (<-chan ProgressSnapshot, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch := make(chan ProgressSnapshot, 1)
+	ch <- t.snapshot()
+	if t.phase.Finished() {
+		close(ch)
+		return ch, func() {}
+	}
+
+	t.subscribers[ch] = struct{}{}
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.subscribers[ch]; ok {
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Snapshot returns the current state of the upload
+func (t *ProgressTracker) Snapshot() ProgressSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+// snapshot builds a ProgressSnapshot. Callers must hold t.mu.
+func (t *ProgressTracker) snapshot() ProgressSnapshot {
+	snap := ProgressSnapshot{
+		ID:            t.id,
+		Phase:         t.phase,
+		TotalBytes:    t.total,
+		BytesReceived: t.received,
+		BytesSent:     t.sent,
+		ETA:           -1,
+		Chunk:         t.chunk,
+		Chunks:        t.chunks,
+		Retries:       t.retries,
+		Error:         t.err,
+	}
+
+	current := t.received
+	if t.phase == PhaseUploading || t.phase == PhaseDone {
+		current = t.sent
+	}
+	if t.total > 0 {
+		snap.Percent = float64(current) / float64(t.total) * 100
+	}
+
+	if t.phase == PhaseReceiving || t.phase == PhaseUploading {
+		elapsed := time.Since(t.phaseStart).Seconds()
+		if elapsed > 0 {
+			snap.Throughput = float64(current-t.phaseOffset) / elapsed
+		}
+		if snap.Throughput > 0 && t.total > 0 {
+			snap.ETA = float64(t.total-current) / snap.Throughput
+		}
+	}
+
+	return snap
+}
+
+// notify sends the latest snapshot to subscribers, replacing any unread one.
+// Unforced notifications are throttled. Callers must hold t.mu.
+func (t *ProgressTracker) notify(force bool) {
+	if len(t.subscribers) == 0 {
+		return
+	}
+	if !force && time.Since(t.lastNotify) < progressNotifyInterval {
+		return
+	}
+	t.lastNotify = time.Now()
+
+	snap := t.snapshot()
+	for ch := range t.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- snap
+	}
+}
+
+// UploadEventsHandler streams the progress of an upload as Server-Sent Events
+func UploadEventsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	id := r.PathValue("id")
+	if !uploadIDPattern.MatchString(id) {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid upload ID: %s", id), "Invalid request")
+		return
+	}
+
+	// Event streams outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Unable to clear write deadline for event stream: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	updates, unsubscribe := watchProgressTracker(id).Subscribe()
+	defer unsubscribe()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			rc.Flush()
+		case snap, ok := <-updates:
+			if !ok {
+				return
+			}
+			event := "progress"
+			if snap.Phase.Finished() {
+				event = string(snap.Phase)
+			}
+			writeProgressEvent(w, event, snap)
+			rc.Flush()
+			if event != "progress" {
+				return
+			}
+		}
+	}
+}
+
+// writeProgressEvent writes a single SSE event
+func writeProgressEvent(w http.ResponseWriter, event string, snap ProgressSnapshot) {
+	data, _ := json.Marshal(snap)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// UploadCancelHandler handles DELETE /uploads/{id}, which aborts an active upload or job.
+// The OneDrive upload session is deleted so the partial data is discarded. Jobs are cancelled
+// with the cancel token returned when they were accepted, or with the admin token.
+func UploadCancelHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Cancel-Token")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "DELETE" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	id := r.PathValue("id")
+	progressTrackersMu.Lock()
+	tracker, ok := progressTrackers[id]
+	progressTrackersMu.Unlock()
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, fmt.Errorf("upload %s not found", id), "Upload not found")
+		return
+	}
+	if !tracker.checkCancel(w, r) {
+		return
+	}
+
+	if err := tracker.Cancel(); err != nil {
+		sendErrorResponse(w, http.StatusConflict, err, "Upload cannot be cancelled")
+		return
+	}
+	log.Printf("Cancellation requested for upload %s", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "cancelling",
+		"message":  "Upload cancellation requested",
+		"uploadId": id,
+	})
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// autoRemote is the remote name that lets the server pick a remote
+	autoRemote = "auto"
+	// defaultQuotaCacheTTL is how long a drive's quota is reused before it is fetched again
+	defaultQuotaCacheTTL = time.Minute
+	// quotaFetchTimeout bounds a quota lookup, so a pre-flight check never stalls an upload for long
+	quotaFetchTimeout = 10 * time.Second
+	// quotaFailureTTL is how long a failed lookup is remembered before it is tried again
+	quotaFailureTTL = 30 * time.Second
+)
+
+// Remote selection policies for remote=auto
+const (
+	policyMostFree   = "most-free"
+	policyRoundRobin = "round-robin"
+	policyWeighted   = "weighted"
+)
+
+// errInsufficientStorage is returned when an upload does not fit in the remaining space of a drive
+var errInsufficientStorage = errors.New("insufficient storage")
+
+// quotaEntry is the cached quota of one remote
+type quotaEntry struct {
+	mu        sync.Mutex
+	quota     *azure.DriveQuota
+	fetchedAt time.Time
+	err       error // last failed lookup
+	failedAt  time.Time
+}
+
+var (
+	quotaCache   = make(map[string]*quotaEntry)
+	quotaCacheMu sync.Mutex
+)
+
+// quotaEntryFor returns the cache entry for remote, creating it if needed
+func quotaEntryFor(remote string) *quotaEntry {
+	quotaCacheMu.Lock()
+	defer quotaCacheMu.Unlock()
+	entry, ok := quotaCache[remote]
+	if !ok {
+		entry = &quotaEntry{}
+		quotaCache[remote] = entry
+	}
+	return entry
+}
+
+// load returns the cached quota, fetching it if it is older than QUOTA_CACHE_TTL. Callers must hold e.mu.
+func (e *quotaEntry) load(ctx context.Context, remote string) (*azure.DriveQuota, error) {
+	ttl := config.GetEnvDurationWithDefault("QUOTA_CACHE_TTL", defaultQuotaCacheTTL)
+	if e.quota != nil && time.Since(e.fetchedAt) < ttl {
+		return e.quota, nil
+	}
+	if e.err != nil && time.Since(e.failedAt) < quotaFailureTTL {
+		return nil, e.err
+	}
+
+	quota, err := fetchQuota(ctx, remote)
+	if err != nil {
+		e.err, e.failedAt = err, time.Now()
+		return nil, err
+	}
+	e.quota, e.fetchedAt, e.err = quota, time.Now(), nil
+	return quota, nil
+}
+
+// fetchQuota asks OneDrive for the quota of remote
+func fetchQuota(ctx context.Context, remote string) (*azure.DriveQuota, error) {
+	ctx, cancel := context.WithTimeout(ctx, quotaFetchTimeout)
+	defer cancel()
+
+	client, err := newRemoteClient(remote)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetDriveQuota(ctx, &http.Client{Timeout: quotaFetchTimeout})
+}
+
+// getRemoteQuota returns a copy of the cached quota of remote
+func getRemoteQuota(ctx context.Context, remote string) (*azure.DriveQuota, error) {
+	entry := quotaEntryFor(remote)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	quota, err := entry.load(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	copied := *quota
+	return &copied, nil
+}
+
+// checkQuota returns errInsufficientStorage if size bytes do not fit on remote.
+// Unknown sizes pass, and so do all uploads if the quota cannot be fetched.
+func checkQuota(ctx context.Context, remote string, size int64) error {
+	_, err := useQuota(ctx, remote, size, false)
+	return err
+}
+
+// claimQuota checks that size bytes fit on remote like checkQuota, and subtracts them from
+// the cached remaining space so concurrent uploads cannot all claim the same space.
+// The claim lasts until the quota is fetched again, or until the returned release func
+// gives the space back, which callers do when the upload does not go through.
+func claimQuota(ctx context.Context, remote string, size int64) (func(), error) {
+	return useQuota(ctx, remote, size, true)
+}
+
+// noRelease is the release func of claims that took no space
+func noRelease() {}
+
+// useQuota implements checkQuota and claimQuota
+func useQuota(ctx context.Context, remote string, size int64, claim bool) (func(), error) {
+	if size <= 0 {
+		return noRelease, nil
+	}
+
+	entry := quotaEntryFor(remote)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	quota, err := entry.load(ctx, remote)
+	if err != nil {
+		log.Printf("Unable to check quota of %s: %v", remote, err)
+		return noRelease, nil
+	}
+
+	if size > quota.Remaining {
+		return nil, fmt.Errorf("%w: %s has %d bytes left, the upload needs %d", errInsufficientStorage, remote, quota.Remaining, size)
+	}
+	if !claim {
+		return noRelease, nil
+	}
+
+	quota.Remaining -= size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			entry.mu.Lock()
+			defer entry.mu.Unlock()
+			// A quota fetched since the claim never counted it
+			if entry.quota == quota {
+				quota.Remaining += size
+			}
+		})
+	}, nil
+}
+
+// remoteSelector picks remotes for remote=auto
+type remoteSelector struct {
+	policy  string
+	remotes []string
+	weights map[string]int
+
+	mu      sync.Mutex
+	next    int            // round-robin position
+	current map[string]int // smooth weighted round-robin state
+}
+
+var (
+	remoteSelectorInstance *remoteSelector
+	remoteSelectorOnce     sync.Once
+)
+
+// getRemoteSelector returns the selector configured from the environment:
+//
+//	AUTO_REMOTES        remotes remote=auto picks from (default: all)
+//	AUTO_REMOTE_POLICY  most-free, round-robin or weighted
+//	REMOTE_WEIGHTS      weights for the weighted policy, e.g. oned=3,saurajcf=1
+func getRemoteSelector() *remoteSelector {
+	remoteSelectorOnce.Do(func() {
+		selector := &remoteSelector{
+			policy:  config.GetEnvWithDefault("AUTO_REMOTE_POLICY", policyMostFree),
+			weights: make(map[string]int),
+			current: make(map[string]int),
+		}
+
+		for _, remote := range strings.Split(config.GetEnvWithDefault("AUTO_REMOTES", ""), ",") {
+			remote = strings.TrimSpace(remote)
+			if _, ok := rootFolders[remote]; ok {
+				selector.remotes = append(selector.remotes, remote)
+			} else if remote != "" {
+				log.Printf("Ignoring unknown remote %s in AUTO_REMOTES", remote)
+			}
+		}
+		if len(selector.remotes) == 0 {
+			for remote := range rootFolders {
+				selector.remotes = append(selector.remotes, remote)
+			}
+			sort.Strings(selector.remotes)
+		}
+
+		for remote, value := range config.GetEnvMap("REMOTE_WEIGHTS") {
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight < 0 {
+				log.Printf("Ignoring weight %q for %s", value, remote)
+				continue
+			}
+			selector.weights[remote] = weight
+		}
+
+		switch selector.policy {
+		case policyMostFree, policyRoundRobin, policyWeighted:
+		default:
+			log.Printf("Unknown AUTO_REMOTE_POLICY %q, using %s", selector.policy, policyMostFree)
+			selector.policy = policyMostFree
+		}
+		log.Printf("remote=auto picks from %s by %s", strings.Join(selector.remotes, ", "), selector.policy)
+		remoteSelectorInstance = selector
+	})
+	return remoteSelectorInstance
+}
+
+// weight returns the weight of remote, 1 unless configured
+func (s *remoteSelector) weight(remote string) int {
+	if weight, ok := s.weights[remote]; ok {
+		return weight
+	}
+	return 1
+}
+
+// selectRemote picks a remote with room for size bytes (-1 if unknown)
+func (s *remoteSelector) selectRemote(ctx context.Context, size int64) (string, error) {
+	// Remotes whose quota cannot be fetched are unlikely to take an upload either, so they are skipped
+	var (
+		candidates []string
+		lastErr    error
+	)
+	remaining := make(map[string]int64, len(s.remotes))
+	for _, remote := range s.remotes {
+		quota, err := getRemoteQuota(ctx, remote)
+		if err != nil {
+			log.Printf("Unable to check quota of %s: %v", remote, err)
+			lastErr = err
+			continue
+		}
+		remaining[remote] = quota.Remaining
+		if size > quota.Remaining {
+			continue
+		}
+		candidates = append(candidates, remote)
+	}
+	if len(candidates) == 0 {
+		if len(remaining) == 0 && lastErr != nil {
+			return "", fmt.Errorf("no remote is available: %w", lastErr)
+		}
+		return "", fmt.Errorf("%w: no remote has %d bytes left", errInsufficientStorage, size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.policy {
+	case policyRoundRobin:
+		remote := candidates[s.next%len(candidates)]
+		s.next++
+		return remote, nil
+
+	case policyWeighted:
+		// Smooth weighted round-robin: every candidate gains its weight, the leader is picked
+		// and pays back the total, which spreads picks evenly in proportion to the weights
+		var best string
+		total := 0
+		for _, remote := range candidates {
+			weight := s.weight(remote)
+			total += weight
+			s.current[remote] += weight
+			if weight > 0 && (best == "" || s.current[remote] > s.current[best]) {
+				best = remote
+			}
+		}
+		if best == "" {
+			return "", fmt.Errorf("no remote with a weight above 0 has room for the upload")
+		}
+		s.current[best] -= total
+		return best, nil
+
+	default:
+		best := candidates[0]
+		for _, remote := range candidates[1:] {
+			if remaining[remote] > remaining[best] {
+				best = remote
+			}
+		}
+		return best, nil
+	}
+}
+
+// resolveRemote picks a remote for remote=auto. Whether the upload fits on a requested
+// remote is checked by connectRemote, which can fail over to another one.
+func resolveRemote(ctx context.Context, opts *uploadOptions, size int64) error {
+	if opts.Remote != autoRemote {
+		return nil
+	}
+
+	remote, err := getRemoteSelector().selectRemote(ctx, size)
+	if err != nil {
+		return err
+	}
+	log.Printf("Selected remote %s for upload of %d bytes", remote, size)
+	opts.Remote = remote
+	return nil
+}
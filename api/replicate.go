@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replica is the copy of an upload on another remote
+type Replica struct {
+	State        JobState   `json:"state"`
+	DownloadURL  string     `json:"downloadURL,omitempty"`
+	QuickXorHash string     `json:"quickXorHash,omitempty"`
+	Verified     bool       `json:"verified"`
+	SidecarURL   string     `json:"sidecarURL,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	ErrorCode    string     `json:"errorCode,omitempty"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+}
+
+// finished reports whether the replica reached a terminal state
+func (replica *Replica) finished() bool {
+	return replica.State == JobDone || replica.State == JobFailed
+}
+
+// replicating reports whether any replica of the job is still being uploaded
+func (job *Job) replicating() bool {
+	for _, replica := range job.Replicas {
+		if !replica.finished() {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns a copy of the job that does not share its replicas or URLs
+func (job *Job) snapshot() Job {
+	copied := *job
+	if job.Replicas != nil {
+		copied.Replicas = make(map[string]*Replica, len(job.Replicas))
+		for remote, replica := range job.Replicas {
+			replicaCopy := *replica
+			copied.Replicas[remote] = &replicaCopy
+		}
+	}
+	copied.DownloadURLs = maps.Clone(job.DownloadURLs)
+	return copied
+}
+
+// parseReplicaRemotes parses the comma separated remotes of replicateTo
+func parseReplicaRemotes(value string) ([]string, error) {
+	var remotes []string
+	seen := make(map[string]bool)
+	for _, remote := range strings.Split(value, ",") {
+		remote = strings.TrimSpace(remote)
+		if remote == "" || seen[remote] {
+			continue
+		}
+		if _, ok := rootFolders[remote]; !ok {
+			return nil, fmt.Errorf("invalid replica remote: %s", remote)
+		}
+		seen[remote] = true
+		remotes = append(remotes, remote)
+	}
+	return remotes, nil
+}
+
+// startReplication copies a finished upload to the remotes of opts.ReplicateTo in the background,
+// uploading the replicas in parallel from the spooled file and recording each one in the job.
+// It takes over file and deletes it once every replica is done. The remotes being replicated
+// to are returned; the remote that took the upload is left out.
+func startReplication(store *JobStore, jobID string, opts *uploadOptions, spec *uploadSpec, result *uploadResult, file *os.File) []string {
+	var remotes []string
+	for _, remote := range opts.ReplicateTo {
+		if remote != result.Remote {
+			remotes = append(remotes, remote)
+		}
+	}
+
+	store.Update(jobID, func(job *Job) {
+		job.DownloadURLs = map[string]string{result.Remote: result.DownloadURL}
+		job.Replicas = make(map[string]*Replica, len(remotes))
+		for _, remote := range remotes {
+			job.Replicas[remote] = &Replica{State: JobQueued, UpdatedAt: time.Now()}
+		}
+	})
+	if len(remotes) == 0 {
+		removeTempFile(file)
+		return nil
+	}
+
+	log.Printf("Replicating %s to %s", result.FileName, strings.Join(remotes, ", "))
+	go func() {
+		defer removeTempFile(file)
+		var wg sync.WaitGroup
+		for _, remote := range remotes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				replicate(store, jobID, opts, spec, result, file, remote)
+			}()
+		}
+		wg.Wait()
+		log.Printf("Replication of job %s finished", jobID)
+	}()
+	return remotes
+}
+
+// replicate uploads one replica and records its outcome in the job
+func replicate(store *JobStore, jobID string, opts *uploadOptions, spec *uploadSpec, primary *uploadResult, file *os.File, remote string) {
+	update := func(fn func(replica *Replica)) {
+		store.Update(jobID, func(job *Job) {
+			if replica, ok := job.Replicas[remote]; ok {
+				fn(replica)
+				replica.UpdatedAt = time.Now()
+			}
+		})
+	}
+
+	result, err := uploadReplica(context.Background(), jobID, opts, spec, primary, file, remote, update)
+	if err != nil {
+		log.Printf("Replica of job %s on %s failed: %v", jobID, remote, err)
+		update(func(replica *Replica) {
+			replica.State = JobFailed
+			replica.Error = err.Error()
+			replica.ErrorCode = errorCode(err)
+		})
+		return
+	}
+
+	log.Printf("Replica of job %s on %s completed: %s", jobID, remote, result.DownloadURL)
+	store.Update(jobID, func(job *Job) {
+		if replica, ok := job.Replicas[remote]; ok {
+			replica.State = JobDone
+			replica.DownloadURL = result.DownloadURL
+			replica.QuickXorHash = result.QuickXorHash
+			replica.Verified = result.Verified
+			replica.SidecarURL = result.SidecarURL
+			if !result.ExpiresAt.IsZero() {
+				expiresAt := result.ExpiresAt
+				replica.ExpiresAt = &expiresAt
+			}
+			replica.UpdatedAt = time.Now()
+		}
+		if job.DownloadURLs == nil {
+			job.DownloadURLs = make(map[string]string)
+		}
+		job.DownloadURLs[remote] = result.DownloadURL
+	})
+}
+
+// uploadReplica uploads the spooled file to remote once a worker is free, under the name the
+// primary upload was stored as, and checks that the replica's hash matches the primary's.
+// Replicas run at low priority so they do not hold up other uploads.
+func uploadReplica(ctx context.Context, jobID string, opts *uploadOptions, spec *uploadSpec, primary *uploadResult, file *os.File, remote string, update func(func(*Replica))) (result *uploadResult, err error) {
+	client, releaseQuota, err := claimRemote(ctx, remote, spec.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			releaseQuota()
+		}
+	}()
+
+	ticket, err := scheduleReplica(ctx, jobID+"@"+remote, opts.Client, remote)
+	if err != nil {
+		return nil, err
+	}
+	defer ticket.release()
+	if err := ticket.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	update(func(replica *Replica) {
+		replica.State = JobUploading
+	})
+
+	replica := *spec
+	replica.Filename = primary.FileName
+	replica.Fallbacks, replica.Attempted = nil, nil
+	replica.quotaRelease, replica.ticket = nil, nil
+	replica.Params.Progress = nil
+	replica.moveTo(remote, client)
+
+	body := io.NewSectionReader(file, 0, spec.Size)
+	result, err = uploadAndVerify(ctx, client, replica.Params, body, spec.Size, func() {
+		update(func(replica *Replica) {
+			replica.State = JobVerifying
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.QuickXorHash != primary.QuickXorHash {
+		return nil, fmt.Errorf("%w: primary %s, replica %s", errHashMismatch, primary.QuickXorHash, result.QuickXorHash)
+	}
+
+	if result.FileName == "" {
+		result.FileName = replica.Filename
+	}
+	result.DownloadURL = buildDownloadURL(remote, spec.RemoteFolder, result.FileName)
+
+	var sidecarID string
+	if spec.WriteSidecar {
+		result.SidecarURL, sidecarID, err = uploadSidecar(ctx, client, &replica, result.FileName, primary.Checksums["sha256"])
+		if err != nil {
+			log.Printf("Failed to write checksum sidecar for replica %s on %s: %v", result.FileName, remote, err)
+		}
+	}
+	scheduleUploadExpiry(&replica, result, sidecarID)
+	return result, nil
+}
+
+// scheduleReplica queues a replica for a worker at low priority. While the remote's queue is
+// full it tries again after UPLOAD_QUEUE_RETRY_AFTER rather than giving the replica up.
+func scheduleReplica(ctx context.Context, id, client, remote string) (*uploadTicket, error) {
+	for {
+		ticket, err := getUploadScheduler().schedule(id, client, remote, priorityLow)
+		if !errors.Is(err, errUploadQueueFull) {
+			return ticket, err
+		}
+
+		log.Printf("Replica %s waiting for room in the queue: %v", id, err)
+		select {
+		case <-time.After(queueRetryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// defaultUploadWorkers is how many uploads run at once across all remotes
+	defaultUploadWorkers = 8
+	// defaultPriorityWorkers is how many of the workers are kept free for high priority uploads
+	defaultPriorityWorkers = 1
+)
+
+// uploadPriority orders queued uploads, set with X-Upload-Priority
+type uploadPriority int
+
+// Upload priorities
+const (
+	priorityLow    uploadPriority = -1
+	priorityNormal uploadPriority = 0
+	priorityHigh   uploadPriority = 1
+)
+
+// parseUploadPriority parses low, normal or high; empty means normal
+func parseUploadPriority(value string) (uploadPriority, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "normal":
+		return priorityNormal, nil
+	case "low":
+		return priorityLow, nil
+	case "high":
+		return priorityHigh, nil
+	}
+	return priorityNormal, fmt.Errorf("invalid priority: %s (must be low, normal or high)", value)
+}
+
+// String returns the priority's name
+func (p uploadPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// uploadScheduler runs the uploads of all requests and jobs on a shared pool of workers.
+// Chunks of one upload session must be sent in order, so uploads run in parallel across
+// files instead of within one. Waiting uploads are picked by priority, then from the
+// client with the fewest running uploads, then in arrival order, so one client or one
+// large file cannot hold up everyone else. Part of the pool is kept for high priority
+// uploads, and the per remote limits from limits.go are honored.
+type uploadScheduler struct {
+	mu       sync.Mutex
+	workers  int
+	reserved int // workers only high priority uploads may use
+	running  int
+	ordinary int // running uploads below high priority
+	queue    []*uploadTicket
+
+	runningByRemote map[string]int
+	queuedByRemote  map[string]int
+	runningByClient map[string]int
+	activeByClient  map[string]int    // queued and running tickets
+	lastServed      map[string]uint64 // dispatch number of each active client's latest upload
+	dispatched      uint64
+	submitted       uint64
+}
+
+var (
+	uploadSchedulerInstance *uploadScheduler
+	uploadSchedulerOnce     sync.Once
+)
+
+// getUploadScheduler returns the shared scheduler, sized from the environment:
+//
+//	UPLOAD_WORKERS           uploads running at once across all remotes
+//	UPLOAD_PRIORITY_WORKERS  workers kept free for high priority uploads
+func getUploadScheduler() *uploadScheduler {
+	uploadSchedulerOnce.Do(func() {
+		workers := config.GetEnvIntWithDefault("UPLOAD_WORKERS", defaultUploadWorkers)
+		reserved := config.GetEnvIntWithDefault("UPLOAD_PRIORITY_WORKERS", defaultPriorityWorkers)
+		uploadSchedulerInstance = newUploadScheduler(workers, reserved)
+		log.Printf("Upload scheduler running %d workers, %d reserved for high priority uploads",
+			uploadSchedulerInstance.workers, uploadSchedulerInstance.reserved)
+	})
+	return uploadSchedulerInstance
+}
+
+// newUploadScheduler returns a scheduler with the given number of workers
+func newUploadScheduler(workers, reserved int) *uploadScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	if reserved < 0 {
+		reserved = 0
+	}
+	if reserved >= workers {
+		reserved = workers - 1
+	}
+	return &uploadScheduler{
+		workers:         workers,
+		reserved:        reserved,
+		runningByRemote: make(map[string]int),
+		queuedByRemote:  make(map[string]int),
+		runningByClient: make(map[string]int),
+		activeByClient:  make(map[string]int),
+		lastServed:      make(map[string]uint64),
+	}
+}
+
+// ticketState is where a ticket is in the scheduler
+type ticketState int
+
+const (
+	ticketQueued ticketState = iota
+	ticketRunning
+	ticketReleased
+)
+
+// uploadTicket is an upload's place in the queue, and its worker once granted
+type uploadTicket struct {
+	scheduler *uploadScheduler
+	id        string
+	client    string
+	remote    string
+	priority  uploadPriority
+	seq       uint64
+	state     ticketState
+	ready     chan struct{} // closed once a worker is granted
+}
+
+// schedule queues an upload for a worker. It fails with errUploadQueueFull if the
+// remote already has as many uploads waiting as its queue allows.
+func (s *uploadScheduler) schedule(id, client, remote string, priority uploadPriority) (*uploadTicket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limits := getRemoteLimits(remote)
+	if s.queuedByRemote[remote] >= limits.queueSize && !s.canRun(remote, priority) {
+		return nil, fmt.Errorf("%w: %d uploads to %s are waiting", errUploadQueueFull, s.queuedByRemote[remote], remote)
+	}
+
+	s.submitted++
+	ticket := &uploadTicket{
+		scheduler: s,
+		id:        id,
+		client:    client,
+		remote:    remote,
+		priority:  priority,
+		seq:       s.submitted,
+		ready:     make(chan struct{}),
+	}
+	s.queue = append(s.queue, ticket)
+	s.queuedByRemote[remote]++
+	s.activeByClient[client]++
+	s.dispatch()
+
+	if ticket.state == ticketQueued {
+		log.Printf("Upload %s queued at %s priority, %d uploads waiting", id, priority, len(s.queue))
+	}
+	return ticket, nil
+}
+
+// canRun reports whether an upload to remote at priority could start right away. Callers must hold s.mu.
+func (s *uploadScheduler) canRun(remote string, priority uploadPriority) bool {
+	if s.running >= s.workers {
+		return false
+	}
+	if priority < priorityHigh && s.ordinary >= s.workers-s.reserved {
+		return false
+	}
+	if max := getRemoteLimits(remote).maxConcurrent; max > 0 && s.runningByRemote[remote] >= max {
+		return false
+	}
+	return true
+}
+
+// before reports whether a should be dispatched ahead of b. Callers must hold s.mu.
+func (s *uploadScheduler) before(a, b *uploadTicket) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if s.runningByClient[a.client] != s.runningByClient[b.client] {
+		return s.runningByClient[a.client] < s.runningByClient[b.client]
+	}
+	if s.lastServed[a.client] != s.lastServed[b.client] {
+		return s.lastServed[a.client] < s.lastServed[b.client]
+	}
+	return a.seq < b.seq
+}
+
+// dispatch hands free workers to the best runnable tickets. Callers must hold s.mu.
+func (s *uploadScheduler) dispatch() {
+	for {
+		best := -1
+		for i, ticket := range s.queue {
+			if !s.canRun(ticket.remote, ticket.priority) {
+				continue
+			}
+			if best < 0 || s.before(ticket, s.queue[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return
+		}
+
+		ticket := s.queue[best]
+		s.queue = append(s.queue[:best], s.queue[best+1:]...)
+		s.queuedByRemote[ticket.remote]--
+		s.running++
+		if ticket.priority < priorityHigh {
+			s.ordinary++
+		}
+		s.runningByRemote[ticket.remote]++
+		s.runningByClient[ticket.client]++
+		s.dispatched++
+		s.lastServed[ticket.client] = s.dispatched
+		ticket.state = ticketRunning
+		close(ticket.ready)
+	}
+}
+
+// remove drops a queued ticket. Callers must hold s.mu.
+func (s *uploadScheduler) remove(ticket *uploadTicket) {
+	for i, queued := range s.queue {
+		if queued == ticket {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.queuedByRemote[ticket.remote]--
+			return
+		}
+	}
+}
+
+// finish retires a ticket that is leaving the scheduler. Callers must hold s.mu.
+func (s *uploadScheduler) finish(ticket *uploadTicket) {
+	switch ticket.state {
+	case ticketQueued:
+		s.remove(ticket)
+	case ticketRunning:
+		s.running--
+		if ticket.priority < priorityHigh {
+			s.ordinary--
+		}
+		s.runningByRemote[ticket.remote]--
+		s.runningByClient[ticket.client]--
+		if s.runningByClient[ticket.client] == 0 {
+			delete(s.runningByClient, ticket.client)
+		}
+	case ticketReleased:
+		return
+	}
+	ticket.state = ticketReleased
+
+	// Forget clients without uploads so the maps do not grow
+	s.activeByClient[ticket.client]--
+	if s.activeByClient[ticket.client] == 0 {
+		delete(s.activeByClient, ticket.client)
+		delete(s.lastServed, ticket.client)
+	}
+	s.dispatch()
+}
+
+// granted reports whether the upload may start without waiting
+func (t *uploadTicket) granted() bool {
+	t.scheduler.mu.Lock()
+	defer t.scheduler.mu.Unlock()
+	return t.state == ticketRunning
+}
+
+// wait blocks until the upload is granted a worker. If ctx is done first the ticket
+// leaves the queue and the context's error is returned.
+func (t *uploadTicket) wait(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s := t.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(t)
+	return ctx.Err()
+}
+
+// release frees the upload's worker, or its place in the queue
+func (t *uploadTicket) release() {
+	t.scheduler.mu.Lock()
+	defer t.scheduler.mu.Unlock()
+	t.scheduler.finish(t)
+}
+
+// moveTo moves the ticket to remote, for an upload that fails over. A running upload keeps
+// its worker if remote has room for it, and otherwise gives the worker up and waits in
+// remote's queue, keeping its place in arrival order. If ctx is done first the ticket
+// leaves the queue and the context's error is returned.
+func (t *uploadTicket) moveTo(ctx context.Context, remote string) error {
+	s := t.scheduler
+	s.mu.Lock()
+	switch t.state {
+	case ticketQueued:
+		s.queuedByRemote[t.remote]--
+		t.remote = remote
+		s.queuedByRemote[remote]++
+	case ticketRunning:
+		s.runningByRemote[t.remote]--
+		t.remote = remote
+		if max := getRemoteLimits(remote).maxConcurrent; max > 0 && s.runningByRemote[remote] >= max {
+			s.running--
+			if t.priority < priorityHigh {
+				s.ordinary--
+			}
+			s.runningByClient[t.client]--
+			if s.runningByClient[t.client] == 0 {
+				delete(s.runningByClient, t.client)
+			}
+			t.state = ticketQueued
+			t.ready = make(chan struct{})
+			s.queue = append(s.queue, t)
+			s.queuedByRemote[remote]++
+		} else {
+			s.runningByRemote[remote]++
+		}
+	}
+	s.dispatch()
+	ready, queued := t.ready, t.state == ticketQueued
+	s.mu.Unlock()
+
+	if queued {
+		log.Printf("Upload %s waiting for a worker on %s after failing over", t.id, remote)
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(t)
+	return ctx.Err()
+}
+
+// uploadClientKey identifies the client a request came from for fair scheduling.
+// Behind a proxy UPLOAD_CLIENT_HEADER names the header carrying the client address,
+// e.g. X-Forwarded-For; otherwise the connection's remote address is used.
+func uploadClientKey(r *http.Request) string {
+	if header := config.GetEnvWithDefault("UPLOAD_CLIENT_HEADER", ""); header != "" {
+		if value := r.Header.Get(header); value != "" {
+			client, _, _ := strings.Cut(value, ",")
+			return strings.TrimSpace(client)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// setTestLimits gives remote the concurrency and queue limits for the duration of the test
+func setTestLimits(t *testing.T, remote string, maxConcurrent, queueSize int) {
+	t.Helper()
+	limitsOnce.Do(loadLimits)
+	limitsByRemote[remote] = &remoteLimits{maxConcurrent: maxConcurrent, queueSize: queueSize}
+	t.Cleanup(func() { delete(limitsByRemote, remote) })
+}
+
+// runningIDs returns the IDs of the tickets holding a worker
+func runningIDs(tickets []*uploadTicket) []string {
+	var ids []string
+	for _, ticket := range tickets {
+		if ticket.granted() {
+			ids = append(ids, ticket.id)
+		}
+	}
+	return ids
+}
+
+func TestUploadSchedulerOrder(t *testing.T) {
+	type upload struct {
+		id       string
+		client   string
+		priority uploadPriority
+	}
+
+	tests := []struct {
+		name    string
+		uploads []upload
+		want    []string // order the uploads are granted the single worker in
+	}{
+		{
+			name: "arrival order",
+			uploads: []upload{
+				{"a1", "a", priorityNormal}, {"b1", "b", priorityNormal}, {"c1", "c", priorityNormal},
+			},
+			want: []string{"a1", "b1", "c1"},
+		},
+		{
+			name: "priority before arrival",
+			uploads: []upload{
+				{"first", "a", priorityNormal}, {"low", "b", priorityLow}, {"normal", "c", priorityNormal}, {"high", "d", priorityHigh},
+			},
+			want: []string{"first", "high", "normal", "low"},
+		},
+		{
+			name: "clients take turns",
+			uploads: []upload{
+				{"a1", "a", priorityNormal}, {"a2", "a", priorityNormal}, {"a3", "a", priorityNormal},
+				{"b1", "b", priorityNormal}, {"b2", "b", priorityNormal}, {"c1", "c", priorityNormal},
+			},
+			want: []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		{
+			name: "priority before fairness",
+			uploads: []upload{
+				{"a1", "a", priorityNormal}, {"b1", "b", priorityNormal}, {"a2", "a", priorityHigh},
+			},
+			want: []string{"a1", "a2", "b1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUploadScheduler(1, 0)
+			tickets := make(map[string]*uploadTicket)
+			var all []*uploadTicket
+			for _, u := range tt.uploads {
+				ticket, err := s.schedule(u.id, u.client, "test-order", u.priority)
+				if err != nil {
+					t.Fatalf("schedule(%s) failed: %v", u.id, err)
+				}
+				tickets[u.id] = ticket
+				all = append(all, ticket)
+			}
+
+			var order []string
+			for range tt.uploads {
+				running := runningIDs(all)
+				if len(running) != 1 {
+					t.Fatalf("after %v, running %v, want exactly one", order, running)
+				}
+				order = append(order, running[0])
+				tickets[running[0]].release()
+			}
+			if !reflect.DeepEqual(order, tt.want) {
+				t.Errorf("granted in order %v, want %v", order, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadSchedulerReservedWorkers(t *testing.T) {
+	s := newUploadScheduler(2, 1)
+	normal1, _ := s.schedule("normal1", "a", "test-reserved", priorityNormal)
+	normal2, _ := s.schedule("normal2", "b", "test-reserved", priorityNormal)
+	high, _ := s.schedule("high", "c", "test-reserved", priorityHigh)
+
+	all := []*uploadTicket{normal1, normal2, high}
+	if got, want := runningIDs(all), []string{"normal1", "high"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("running %v, want %v", got, want)
+	}
+
+	// The reserved worker is not handed to normal uploads even when it is free
+	high.release()
+	if got, want := runningIDs(all), []string{"normal1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after the high priority upload, running %v, want %v", got, want)
+	}
+	normal1.release()
+	if got, want := runningIDs(all), []string{"normal2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after normal1, running %v, want %v", got, want)
+	}
+}
+
+func TestUploadSchedulerRemoteLimits(t *testing.T) {
+	setTestLimits(t, "test-limited", 1, 1)
+	s := newUploadScheduler(4, 0)
+
+	first, _ := s.schedule("first", "a", "test-limited", priorityNormal)
+	second, _ := s.schedule("second", "b", "test-limited", priorityNormal)
+	other, _ := s.schedule("other", "c", "test-other", priorityNormal)
+	if got, want := runningIDs([]*uploadTicket{first, second, other}), []string{"first", "other"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("running %v, want %v", got, want)
+	}
+
+	if _, err := s.schedule("third", "d", "test-limited", priorityNormal); !errors.Is(err, errUploadQueueFull) {
+		t.Errorf("schedule with a full queue = %v, want errUploadQueueFull", err)
+	}
+
+	first.release()
+	if !second.granted() {
+		t.Errorf("second upload not granted once the remote had room")
+	}
+}
+
+func TestUploadTicketWaitCancelled(t *testing.T) {
+	s := newUploadScheduler(1, 0)
+	running, _ := s.schedule("running", "a", "test-cancel", priorityNormal)
+	cancelled, _ := s.schedule("cancelled", "b", "test-cancel", priorityNormal)
+	next, _ := s.schedule("next", "c", "test-cancel", priorityNormal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cancelled.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait = %v, want context.Canceled", err)
+	}
+
+	running.release()
+	if cancelled.granted() || !next.granted() {
+		t.Errorf("cancelled upload kept its place in the queue")
+	}
+	if err := next.wait(context.Background()); err != nil {
+		t.Errorf("wait on a granted ticket = %v", err)
+	}
+}
+
+func TestUploadTicketMoveTo(t *testing.T) {
+	setTestLimits(t, "test-busy", 1, 4)
+	s := newUploadScheduler(4, 0)
+	busy, _ := s.schedule("busy", "a", "test-busy", priorityNormal)
+	moving, _ := s.schedule("moving", "b", "test-failing", priorityNormal)
+
+	// A running upload that fails over to a full remote gives its worker up and waits there
+	moved := make(chan error, 1)
+	go func() { moved <- moving.moveTo(context.Background(), "test-busy") }()
+	for {
+		s.mu.Lock()
+		queued := moving.state == ticketQueued
+		s.mu.Unlock()
+		if queued {
+			break
+		}
+	}
+	if s.runningByRemote["test-failing"] != 0 {
+		t.Errorf("moved upload still counted on the remote it left")
+	}
+
+	busy.release()
+	if err := <-moved; err != nil {
+		t.Fatalf("moveTo = %v", err)
+	}
+	if !moving.granted() || moving.remote != "test-busy" {
+		t.Errorf("moved upload not running on test-busy")
+	}
+
+	// With room on the new remote it keeps its worker
+	if err := moving.moveTo(context.Background(), "test-other"); err != nil || !moving.granted() {
+		t.Errorf("moveTo a free remote = %v, granted %t", err, moving.granted())
+	}
+}
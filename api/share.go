@@ -0,0 +1,312 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+// shareOptions describe a OneDrive sharing link to create
+type shareOptions struct {
+	Type      string        // view, edit or embed
+	Scope     string        // anonymous or organization, empty for the drive's default
+	ExpiresIn time.Duration // 0 for a link that does not expire
+	Password  string
+}
+
+// validate checks the link type and scope. Edit links let anyone holding them change the
+// file, so they are refused unless SHARE_ALLOW_EDIT is set.
+func (opts *shareOptions) validate() error {
+	switch opts.Type {
+	case azure.LinkView, azure.LinkEmbed:
+	case azure.LinkEdit:
+		if allowed, _ := strconv.ParseBool(config.GetEnvWithDefault("SHARE_ALLOW_EDIT", "false")); !allowed {
+			return fmt.Errorf("edit links are disabled (set SHARE_ALLOW_EDIT to allow them)")
+		}
+	default:
+		return fmt.Errorf("invalid share link type: %s (must be view, edit or embed)", opts.Type)
+	}
+	switch opts.Scope {
+	case "", azure.ScopeAnonymous, azure.ScopeOrganization:
+	default:
+		return fmt.Errorf("invalid share link scope: %s (must be anonymous or organization)", opts.Scope)
+	}
+	return nil
+}
+
+// parseShareLink parses the shareLink upload option: a link type optionally followed by
+// parameters, e.g. "view; scope=anonymous; expiresIn=7d; password=secret". "true" asks
+// for a view link with the drive's default scope.
+func parseShareLink(value string) (*shareOptions, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "false" {
+		return nil, nil
+	}
+
+	linkType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shareLink: %s", value)
+	}
+	if linkType == "true" {
+		linkType = azure.LinkView
+	}
+	opts := &shareOptions{
+		Type:     linkType,
+		Scope:    params["scope"],
+		Password: params["password"],
+	}
+	// Parameter names are case insensitive and come back lower case
+	if opts.ExpiresIn, err = parseExpiresIn(params["expiresin"]); err != nil {
+		return nil, err
+	}
+	for name := range params {
+		switch name {
+		case "scope", "password", "expiresin":
+		default:
+			return nil, fmt.Errorf("invalid shareLink parameter: %s", name)
+		}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// createShareLink creates a sharing link to an item, or fetches the matching link it already has
+func createShareLink(ctx context.Context, client *azure.AzureClient, itemID string, opts *shareOptions) (*azure.Permission, error) {
+	linkOptions := azure.ShareLinkOptions{
+		Type:     opts.Type,
+		Scope:    opts.Scope,
+		Password: opts.Password,
+	}
+	if opts.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(opts.ExpiresIn).UTC()
+		linkOptions.ExpirationDateTime = &expiresAt
+	}
+
+	permission, err := client.CreateLink(ctx, http.DefaultClient, itemID, linkOptions)
+	if err != nil {
+		return nil, err
+	}
+	if permission.Link == nil || permission.Link.WebURL == "" {
+		return nil, fmt.Errorf("sharing link response has no URL")
+	}
+	return permission, nil
+}
+
+// shareUpload creates the sharing link requested for an upload. A failure is reported in the
+// result rather than failing the upload, which has succeeded by then.
+func shareUpload(ctx context.Context, client *azure.AzureClient, spec *uploadSpec, result *uploadResult) {
+	if spec.ShareLink == nil {
+		return
+	}
+
+	permission, err := createShareLink(ctx, client, result.FileID, spec.ShareLink)
+	if err != nil {
+		log.Printf("Failed to create sharing link for %s: %v", result.FileName, err)
+		result.ShareError = err.Error()
+		return
+	}
+	result.ShareURL = permission.Link.WebURL
+	log.Printf("Shared %s as %s", result.FileName, result.ShareURL)
+}
+
+// shareInfo describes a sharing permission of an item
+type shareInfo struct {
+	PermissionID string     `json:"permissionId"`
+	Roles        []string   `json:"roles,omitempty"`
+	Type         string     `json:"type,omitempty"` // links only
+	Scope        string     `json:"scope,omitempty"`
+	ShareURL     string     `json:"shareURL,omitempty"`
+	EmbedHTML    string     `json:"embedHTML,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	HasPassword  bool       `json:"hasPassword,omitempty"`
+	GrantedTo    []string   `json:"grantedTo,omitempty"` // names or addresses of direct grants
+	Inherited    bool       `json:"inherited,omitempty"` // granted on a parent folder
+}
+
+// identityName returns the most readable name of a grant's identity
+func identityName(identities *azure.IdentitySet) string {
+	for _, identity := range []*azure.Identity{identities.User, identities.Group, identities.Application} {
+		switch {
+		case identity == nil:
+		case identity.Email != "":
+			return identity.Email
+		case identity.DisplayName != "":
+			return identity.DisplayName
+		case identity.ID != "":
+			return identity.ID
+		}
+	}
+	return ""
+}
+
+// newShareInfo describes permission
+func newShareInfo(permission *azure.Permission) shareInfo {
+	info := shareInfo{
+		PermissionID: permission.ID,
+		Roles:        permission.Roles,
+		ExpiresAt:    permission.ExpirationDateTime,
+		HasPassword:  permission.HasPassword,
+		Inherited:    permission.InheritedFrom != nil,
+	}
+	if link := permission.Link; link != nil {
+		info.Type = link.Type
+		info.Scope = link.Scope
+		info.ShareURL = link.WebURL
+		info.EmbedHTML = link.WebHTML
+	}
+
+	grants := permission.GrantedToList
+	if permission.GrantedTo != nil {
+		grants = append([]azure.IdentitySet{*permission.GrantedTo}, grants...)
+	}
+	for i := range grants {
+		if name := identityName(&grants[i]); name != "" {
+			info.GrantedTo = append(info.GrantedTo, name)
+		}
+	}
+	return info
+}
+
+// shareRequest is the JSON body of POST /share/{remote}/{path}
+type shareRequest struct {
+	Type      string `json:"type"` // defaults to view
+	Scope     string `json:"scope"`
+	ExpiresIn string `json:"expiresIn"`
+	Password  string `json:"password"`
+}
+
+// ShareHandler serves /share/{remote}/{path}: POST creates a OneDrive sharing link to the item,
+// GET lists its sharing permissions and DELETE revokes the one given by permissionId. The
+// permissions include the links themselves, so every method needs the admin token.
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	if !checkAdmin(w, r) {
+		return
+	}
+
+	remote := r.PathValue("remote")
+	if _, ok := rootFolders[remote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+	relPath := cleanRemotePath(r.PathValue("path"))
+	if relPath == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("path is required"), "Invalid request")
+		return
+	}
+
+	var opts *shareOptions
+	permissionID := r.URL.Query().Get("permissionId")
+	switch r.Method {
+	case "POST":
+		var req shareRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxFilesRequestSize)).Decode(&req); err != nil && err != io.EOF {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err), "Invalid request")
+			return
+		}
+		if req.Type == "" {
+			req.Type = azure.LinkView
+		}
+		opts = &shareOptions{Type: req.Type, Scope: req.Scope, Password: req.Password}
+		var err error
+		if opts.ExpiresIn, err = parseExpiresIn(req.ExpiresIn); err == nil {
+			err = opts.validate()
+		}
+		if err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+			return
+		}
+	case "DELETE":
+		if permissionID == "" {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("permissionId is required"), "Invalid request")
+			return
+		}
+	}
+
+	client, err := openRemote(r.Context(), remote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	item, err := client.GetItemByPath(r.Context(), http.DefaultClient, remoteItemPath(remote, relPath))
+	if err != nil {
+		sendErrorResponse(w, graphErrorStatus(err), err, "Failed to fetch item")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		permissions, err := client.ListPermissions(r.Context(), http.DefaultClient, item.ID)
+		if err != nil {
+			sendErrorResponse(w, graphErrorStatus(err), err, "Failed to list permissions")
+			return
+		}
+		infos := make([]shareInfo, 0, len(permissions))
+		for i := range permissions {
+			infos = append(infos, newShareInfo(&permissions[i]))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   infos,
+		})
+
+	case "POST":
+		permission, err := createShareLink(r.Context(), client, item.ID, opts)
+		if err != nil {
+			sendErrorResponse(w, graphErrorStatus(err), err, "Failed to create sharing link")
+			return
+		}
+		log.Printf("Shared %s on %s as %s", relPath, remote, permission.Link.WebURL)
+
+		response := map[string]interface{}{
+			"status": "success",
+			"data":   newShareInfo(permission),
+			"path":   relPath,
+		}
+		if item.Folder == nil {
+			response["downloadURL"] = newFileInfo(remote, relPath, item).DownloadURL
+		}
+		json.NewEncoder(w).Encode(response)
+
+	case "DELETE":
+		if err := client.DeletePermission(r.Context(), http.DefaultClient, item.ID, permissionID); err != nil {
+			sendErrorResponse(w, graphErrorStatus(err), err, "Failed to revoke permission")
+			return
+		}
+		log.Printf("Revoked permission %s of %s on %s", permissionID, relPath, remote)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":       "success",
+			"message":      "Permission revoked",
+			"permissionId": permissionID,
+		})
+	}
+}
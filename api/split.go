@@ -0,0 +1,506 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// minSplitSize is the smallest part size accepted for split uploads
+	minSplitSize = 1 << 20
+	// maxSplitSize is the largest part size, OneDrive's limit for a single file
+	maxSplitSize = 250 << 30
+	// defaultMaxSplitFileSize caps the total size of a split upload
+	defaultMaxSplitFileSize = 1 << 40
+	// splitFolderSuffix is appended to the file name to name the folder holding its parts
+	splitFolderSuffix = ".parts"
+	// splitManifestName is the name of the manifest inside the parts folder
+	splitManifestName = "manifest.json"
+	// maxSplitManifestSize limits the manifest read back for downloads
+	maxSplitManifestSize = 16 << 20
+	// maxSplitFolderRenames is how many numbered folder names are tried with conflictBehavior=rename
+	maxSplitFolderRenames = 100
+)
+
+// MaxSplitFileSize returns the largest file accepted in split mode, from SPLIT_MAX_FILE_SIZE
+func MaxSplitFileSize() int64 {
+	return config.GetEnvSizeWithDefault("SPLIT_MAX_FILE_SIZE", defaultMaxSplitFileSize)
+}
+
+// parseSplitSize parses the part size of a split upload, such as 1G or 512M.
+// An empty value means the file is uploaded whole.
+func parseSplitSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := config.ParseByteSize(value)
+	if err != nil || size < minSplitSize || size > maxSplitSize {
+		return 0, fmt.Errorf("invalid splitSize: %s (must be between 1M and 250G)", value)
+	}
+	return size, nil
+}
+
+// splitManifest describes a file stored as parts. It is written as manifest.json next to the parts.
+type splitManifest struct {
+	Version      int               `json:"version"`
+	FileName     string            `json:"fileName"`
+	Size         int64             `json:"size"`
+	PartSize     int64             `json:"partSize"`
+	QuickXorHash string            `json:"quickXorHash"` // of the whole file
+	Checksums    map[string]string `json:"checksums,omitempty"`
+	Parts        []splitPart       `json:"parts"`
+	CreatedAt    time.Time         `json:"createdAt"`
+}
+
+// splitPart is one part of a split file
+type splitPart struct {
+	Name         string `json:"name"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+	QuickXorHash string `json:"quickXorHash"`
+	SHA256       string `json:"sha256"`
+}
+
+// validate checks that the parts cover the file exactly, in order
+func (m *splitManifest) validate() error {
+	if m.Version != 1 {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	var offset int64
+	for _, part := range m.Parts {
+		if part.Name == "" || strings.ContainsAny(part.Name, "/\\") || part.Offset != offset || part.Size <= 0 {
+			return fmt.Errorf("invalid manifest part %q", part.Name)
+		}
+		offset += part.Size
+	}
+	if offset != m.Size {
+		return fmt.Errorf("manifest parts add up to %d bytes, expected %d", offset, m.Size)
+	}
+	return nil
+}
+
+// splitURL returns the path GET /split serves the reassembled file from
+func splitURL(remote, remoteFolder, folder string) string {
+	u := url.URL{Path: path.Join("/split", remote, cleanRemotePath(path.Join(remoteFolder, folder)))}
+	return u.EscapedPath()
+}
+
+// uploadSplit uploads spec.Size bytes from body as parts of spec.SplitSize bytes into a
+// <filename>.parts folder, verifying each part, then writes the manifest. The result
+// describes the folder; a failed upload removes it again.
+func uploadSplit(ctx context.Context, client *azure.AzureClient, spec *uploadSpec, body io.Reader, onVerify func()) (*uploadResult, error) {
+	parent := filepath.Join(rootFolders[spec.Remote], spec.RemoteFolder)
+	folder, err := claimSplitFolder(ctx, client, parent, spec.Filename+splitFolderSuffix, spec.Params.ConflictBehavior)
+	if err != nil {
+		return nil, err
+	}
+	folderPath := filepath.Join(parent, folder)
+
+	count := (spec.Size + spec.SplitSize - 1) / spec.SplitSize
+	width := max(3, len(strconv.FormatInt(count, 10)))
+	log.Printf("Uploading %s to %s as %d parts of up to %d bytes", spec.Filename, folderPath, count, spec.SplitSize)
+
+	manifest := &splitManifest{
+		Version:   1,
+		FileName:  spec.Filename,
+		Size:      spec.Size,
+		PartSize:  spec.SplitSize,
+		Parts:     make([]splitPart, 0, count),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	whole := azure.NewQuickXorHash()
+	body = io.TeeReader(body, whole)
+	verified := true
+	for i := int64(0); i < count; i++ {
+		offset := i * spec.SplitSize
+		size := min(spec.SplitSize, spec.Size-offset)
+		name := fmt.Sprintf("%s.part%0*d", spec.Filename, width, i+1)
+
+		params := spec.Params
+		params.RemoteFilePath = filepath.Join(folderPath, name)
+		params.ConflictBehavior = azure.ConflictReplace
+		params.Progress = offsetProgress(spec.Params.Progress, offset, spec.Size)
+
+		// Only the last part finishes sending the file
+		var partVerify func()
+		if i == count-1 {
+			partVerify = onVerify
+		}
+
+		digest := sha256.New()
+		part, err := uploadAndVerify(ctx, client, params, io.TeeReader(io.LimitReader(body, size), digest), size, partVerify)
+		if err != nil {
+			discardSplitFolder(client, folderPath)
+			return nil, fmt.Errorf("part %d of %d: %w", i+1, count, err)
+		}
+		verified = verified && part.Verified
+		manifest.Parts = append(manifest.Parts, splitPart{
+			Name:         name,
+			Offset:       offset,
+			Size:         size,
+			QuickXorHash: part.QuickXorHash,
+			SHA256:       hex.EncodeToString(digest.Sum(nil)),
+		})
+	}
+	manifest.QuickXorHash = azure.EncodeQuickXorHash(whole.Sum(nil))
+	manifest.Checksums = spec.Checksums.Digests()
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		discardSplitFolder(client, folderPath)
+		return nil, err
+	}
+	params := spec.Params
+	params.RemoteFilePath = filepath.Join(folderPath, splitManifestName)
+	params.ConflictBehavior = azure.ConflictReplace
+	params.Progress = nil
+	item, err := client.UploadFromReader(ctx, http.DefaultClient, bytes.NewReader(data), int64(len(data)), params)
+	if err != nil {
+		discardSplitFolder(client, folderPath)
+		return nil, fmt.Errorf("failed to upload split manifest: %w", err)
+	}
+
+	// The folder's ID lets an expiry delete every part at once
+	var folderID string
+	if item.ParentReference != nil {
+		folderID = item.ParentReference.ID
+	}
+	if folderID == "" {
+		folderItem, err := client.GetItemByPath(ctx, http.DefaultClient, folderPath)
+		if err != nil {
+			discardSplitFolder(client, folderPath)
+			return nil, fmt.Errorf("failed to look up split folder: %w", err)
+		}
+		folderID = folderItem.ID
+	}
+
+	log.Printf("Uploaded %s as %d parts to %s", spec.Filename, count, folderPath)
+	return &uploadResult{
+		FileID:       folderID,
+		FileName:     folder,
+		QuickXorHash: manifest.QuickXorHash,
+		Verified:     verified,
+		Parts:        len(manifest.Parts),
+		ManifestURL:  buildDownloadURL(spec.Remote, filepath.Join(spec.RemoteFolder, folder), splitManifestName),
+		SplitURL:     splitURL(spec.Remote, spec.RemoteFolder, folder),
+	}, nil
+}
+
+// claimSplitFolder picks the name of the parts folder according to conflictBehavior:
+// an existing folder fails the upload, is replaced, or (the default) gets a numbered name
+func claimSplitFolder(ctx context.Context, client *azure.AzureClient, parent, name, conflictBehavior string) (string, error) {
+	base := strings.TrimSuffix(name, splitFolderSuffix)
+	for n := 0; n <= maxSplitFolderRenames; n++ {
+		candidate := name
+		if n > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, n, splitFolderSuffix)
+		}
+
+		existing, err := client.GetItemByPath(ctx, http.DefaultClient, filepath.Join(parent, candidate))
+		if isNotFound(err) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch conflictBehavior {
+		case azure.ConflictFail:
+			return "", fmt.Errorf("%w: %s", azure.ErrConflict, candidate)
+		case azure.ConflictReplace:
+			if err := client.DeleteItem(ctx, http.DefaultClient, existing.ID); err != nil {
+				return "", fmt.Errorf("failed to replace %s: %w", candidate, err)
+			}
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no free name for %s", azure.ErrConflict, name)
+}
+
+// discardSplitFolder deletes the parts of a split upload that did not complete
+func discardSplitFolder(client *azure.AzureClient, folderPath string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	folder, err := client.GetItemByPath(ctx, http.DefaultClient, folderPath)
+	if err == nil {
+		err = client.DeleteItem(ctx, http.DefaultClient, folder.ID)
+	}
+	if err != nil && !isNotFound(err) {
+		log.Printf("Failed to remove incomplete split upload %s: %v", folderPath, err)
+	}
+}
+
+// offsetProgress reports the progress of a part as progress of the whole file
+func offsetProgress(progress func(azure.UploadProgress), offset, total int64) func(azure.UploadProgress) {
+	if progress == nil {
+		return nil
+	}
+	return func(p azure.UploadProgress) {
+		p.BytesSent += offset
+		p.TotalBytes = total
+		progress(p)
+	}
+}
+
+// splitReader reads a split file as one contiguous stream. Parts are opened lazily at the
+// current offset, so it can be seeked to serve ranges. A part read from start to end is
+// checked against the QuickXorHash in the manifest.
+type splitReader struct {
+	ctx      context.Context
+	client   *azure.AzureClient
+	folder   string // path of the parts folder
+	manifest *splitManifest
+	urls     map[string]string // download URLs of the parts opened so far
+
+	offset    int64
+	body      io.ReadCloser
+	remaining int64 // bytes left in the open part
+	part      *splitPart
+	hasher    hash.Hash // set when the open part is read from its start
+}
+
+// Read reads from the part containing the current offset, moving on to the next part at its end
+func (r *splitReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		if err := r.open(); err != nil {
+			log.Printf("Reading split file %s failed: %v", r.manifest.FileName, err)
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.body.Read(p)
+	if r.hasher != nil {
+		r.hasher.Write(p[:n])
+	}
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+
+	if r.remaining == 0 {
+		err = r.finishPart()
+	} else if err == io.EOF {
+		err = fmt.Errorf("part %s ended %d bytes early: %w", r.part.Name, r.remaining, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		log.Printf("Reading split file %s failed: %v", r.manifest.FileName, err)
+	}
+	return n, err
+}
+
+// open opens the part containing the current offset from that offset on
+func (r *splitReader) open() error {
+	parts := r.manifest.Parts
+	i := sort.Search(len(parts), func(i int) bool {
+		return parts[i].Offset+parts[i].Size > r.offset
+	})
+	part := &parts[i]
+
+	downloadURL, ok := r.urls[part.Name]
+	if !ok {
+		item, err := r.client.GetItemByPath(r.ctx, http.DefaultClient, filepath.Join(r.folder, part.Name))
+		if err != nil {
+			return fmt.Errorf("part %s: %w", part.Name, err)
+		}
+		if item.Size != part.Size {
+			return fmt.Errorf("part %s is %d bytes, manifest says %d", part.Name, item.Size, part.Size)
+		}
+		downloadURL = item.DownloadURL
+		r.urls[part.Name] = downloadURL
+	}
+
+	start := r.offset - part.Offset
+	body, err := r.client.OpenDownloadRange(r.ctx, http.DefaultClient, downloadURL, start, part.Size-start)
+	if err != nil {
+		return fmt.Errorf("part %s: %w", part.Name, err)
+	}
+
+	r.body = body
+	r.part = part
+	r.remaining = part.Size - start
+	r.hasher = nil
+	if start == 0 && part.QuickXorHash != "" {
+		r.hasher = azure.NewQuickXorHash()
+	}
+	return nil
+}
+
+// finishPart closes the open part once it has been read, verifying it if it was read whole
+func (r *splitReader) finishPart() error {
+	r.closePart()
+	if r.hasher == nil {
+		return nil
+	}
+	hash := azure.EncodeQuickXorHash(r.hasher.Sum(nil))
+	r.hasher = nil
+	if hash != r.part.QuickXorHash {
+		return fmt.Errorf("%w: part %s is %s, manifest says %s", errHashMismatch, r.part.Name, hash, r.part.QuickXorHash)
+	}
+	return nil
+}
+
+// closePart closes the open part, if any
+func (r *splitReader) closePart() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+// Seek moves the offset the next Read starts from
+func (r *splitReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.manifest.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.offset {
+		r.closePart()
+		r.hasher = nil
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the open part
+func (r *splitReader) Close() error {
+	r.closePart()
+	return nil
+}
+
+// readSplitManifest downloads and validates the manifest of the parts folder at folderPath
+func readSplitManifest(ctx context.Context, client *azure.AzureClient, folderPath string) (*splitManifest, error) {
+	item, err := client.GetItemByPath(ctx, http.DefaultClient, filepath.Join(folderPath, splitManifestName))
+	if err != nil {
+		return nil, err
+	}
+	if item.Size > maxSplitManifestSize {
+		return nil, fmt.Errorf("manifest is too large: %d bytes", item.Size)
+	}
+
+	body, err := client.OpenDownload(ctx, http.DefaultClient, item.DownloadURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var manifest splitManifest
+	if err := json.NewDecoder(io.LimitReader(body, maxSplitManifestSize)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// SplitDownloadHandler serves GET /split/{remote}/{path...}, streaming the parts of a split
+// upload back as the original file. The path names the parts folder, with or without its
+// .parts suffix. Range requests and conditional requests are supported.
+func SplitDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, If-Range, If-None-Match, If-Modified-Since")
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Range, Content-Length, Content-Disposition, ETag, Last-Modified")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	remote := r.PathValue("remote")
+	if _, ok := rootFolders[remote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+	folder := cleanRemotePath(r.PathValue("path"))
+	if folder == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("path is required"), "Invalid request")
+		return
+	}
+	if !strings.HasSuffix(folder, splitFolderSuffix) {
+		folder += splitFolderSuffix
+	}
+	folderPath := filepath.Join(rootFolders[remote], folder)
+
+	client, err := openRemote(r.Context(), remote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	manifest, err := readSplitManifest(r.Context(), client, folderPath)
+	if err != nil {
+		if isNotFound(err) {
+			sendErrorResponse(w, http.StatusNotFound, err, "Split file not found")
+			return
+		}
+		sendErrorResponse(w, http.StatusBadGateway, err, "Failed to read split manifest")
+		return
+	}
+
+	// Large files take longer to stream than the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Unable to clear write deadline for split download: %v", err)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(manifest.FileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": manifest.FileName}))
+	w.Header().Set("ETag", strconv.Quote(manifest.QuickXorHash))
+
+	reader := &splitReader{
+		ctx:      r.Context(),
+		client:   client,
+		folder:   folderPath,
+		manifest: manifest,
+		urls:     make(map[string]string),
+	}
+	defer reader.Close()
+
+	log.Printf("Serving split file %s (%d bytes, %d parts) from %s", manifest.FileName, manifest.Size, len(manifest.Parts), remote)
+	http.ServeContent(w, r, manifest.FileName, manifest.CreatedAt, reader)
+}
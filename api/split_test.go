@@ -0,0 +1,111 @@
+package api
+
+import "testing"
+
+func TestSplitManifestValidate(t *testing.T) {
+	part := func(name string, offset, size int64) splitPart {
+		return splitPart{Name: name, Offset: offset, Size: size}
+	}
+
+	tests := []struct {
+		name     string
+		manifest splitManifest
+		wantErr  bool
+	}{
+		{
+			name:     "parts cover the file",
+			manifest: splitManifest{Version: 1, Size: 25, Parts: []splitPart{part("f.part1", 0, 10), part("f.part2", 10, 10), part("f.part3", 20, 5)}},
+		},
+		{
+			name:     "empty file",
+			manifest: splitManifest{Version: 1},
+		},
+		{
+			name:     "unknown version",
+			manifest: splitManifest{Version: 2, Size: 10, Parts: []splitPart{part("f.part1", 0, 10)}},
+			wantErr:  true,
+		},
+		{
+			name:     "parts short of the size",
+			manifest: splitManifest{Version: 1, Size: 25, Parts: []splitPart{part("f.part1", 0, 10), part("f.part2", 10, 10)}},
+			wantErr:  true,
+		},
+		{
+			name:     "parts past the size",
+			manifest: splitManifest{Version: 1, Size: 15, Parts: []splitPart{part("f.part1", 0, 10), part("f.part2", 10, 10)}},
+			wantErr:  true,
+		},
+		{
+			name:     "gap between parts",
+			manifest: splitManifest{Version: 1, Size: 20, Parts: []splitPart{part("f.part1", 0, 10), part("f.part2", 11, 9)}},
+			wantErr:  true,
+		},
+		{
+			name:     "parts out of order",
+			manifest: splitManifest{Version: 1, Size: 20, Parts: []splitPart{part("f.part2", 10, 10), part("f.part1", 0, 10)}},
+			wantErr:  true,
+		},
+		{
+			name:     "empty part",
+			manifest: splitManifest{Version: 1, Size: 10, Parts: []splitPart{part("f.part1", 0, 10), part("f.part2", 10, 0)}},
+			wantErr:  true,
+		},
+		{
+			name:     "unnamed part",
+			manifest: splitManifest{Version: 1, Size: 10, Parts: []splitPart{part("", 0, 10)}},
+			wantErr:  true,
+		},
+		{
+			name:     "part outside the folder",
+			manifest: splitManifest{Version: 1, Size: 10, Parts: []splitPart{part("../secret", 0, 10)}},
+			wantErr:  true,
+		},
+		{
+			name:     "part with a backslash",
+			manifest: splitManifest{Version: 1, Size: 10, Parts: []splitPart{part(`..\secret`, 0, 10)}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.manifest.validate()
+			if tt.wantErr && err == nil {
+				t.Errorf("validate() succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validate() failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseSplitSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: " 512M ", want: 512 << 20},
+		{value: "1G", want: 1 << 30},
+		{value: "1M", want: minSplitSize},
+		{value: "250G", want: maxSplitSize},
+		{value: "1023K", wantErr: true},
+		{value: "251G", wantErr: true},
+		{value: "big", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSplitSize(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSplitSize(%q) = %d, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSplitSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
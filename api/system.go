@@ -225,7 +225,7 @@ func QuotaHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		quota, err := client.GetDriveQuota(httpClient)
+		quota, err := client.GetDriveQuota(r.Context(), httpClient)
 		if err != nil {
 			log.Printf("Error getting quota for remote %s: %v", remote, err)
 			continue
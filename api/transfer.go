@@ -0,0 +1,386 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// maxTransferRequestSize limits the JSON body of POST /transfer
+const maxTransferRequestSize = 64 << 10
+
+// transferRequest is the JSON body of POST /transfer. Paths are relative to each remote's root folder.
+type transferRequest struct {
+	SourceRemote      string `json:"sourceRemote"`
+	SourcePath        string `json:"sourcePath"`
+	DestinationRemote string `json:"destinationRemote"`
+	DestinationPath   string `json:"destinationPath"` // defaults to sourcePath; a trailing / keeps the source name
+	Move              bool   `json:"move"`
+	ChunkSize         int64  `json:"chunkSize"` // in MB (2-32), 0 for the default
+	ConflictBehavior  string `json:"conflictBehavior"`
+	WriteSidecar      bool   `json:"writeSidecar"`
+	Priority          string `json:"priority"`
+	UploadID          string `json:"uploadId"`
+	ExpiresIn         string `json:"expiresIn"`
+	SplitSize         string `json:"splitSize"`
+	ShareLink         string `json:"shareLink"`
+}
+
+// cleanRemotePath normalizes a path within a remote, returning "" for the remote's root
+func cleanRemotePath(p string) string {
+	p = filepath.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	return strings.TrimPrefix(p, "/")
+}
+
+// destination returns the folder and file name the source is copied to
+func (req *transferRequest) destination(sourcePath string) (string, string) {
+	return resolveDestination(req.DestinationPath, sourcePath)
+}
+
+// resolveDestination splits the destination of a copy or move into folder and name.
+// An empty destination is sourcePath itself; one ending with / keeps the source's name.
+func resolveDestination(destination, sourcePath string) (string, string) {
+	if destination == "" {
+		destination = sourcePath
+	} else if strings.HasSuffix(destination, "/") {
+		destination += filepath.Base(sourcePath)
+	}
+	destination = cleanRemotePath(destination)
+
+	folder := filepath.Dir(destination)
+	if folder == "." {
+		folder = ""
+	}
+	return folder, cleanFilename(filepath.Base(destination))
+}
+
+// TransferHandler handles POST /transfer, which copies or moves a file from one remote to
+// another as a background job. The source is streamed from its download URL straight into
+// an upload session on the destination, without touching the local disk.
+func TransferHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, X-Upload-ID")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Only allow POST requests
+	if r.Method != "POST" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	var req transferRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxTransferRequestSize)).Decode(&req); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err), "Invalid request")
+		return
+	}
+
+	// A move deletes the source, so it needs the admin token like deletes through /files
+	if req.Move && !checkAdmin(w, r) {
+		return
+	}
+
+	// Validate parameters
+	if _, ok := rootFolders[req.SourceRemote]; !ok {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid source remote: %s", req.SourceRemote), "Invalid request")
+		return
+	}
+	sourcePath := cleanRemotePath(req.SourcePath)
+	if sourcePath == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("sourcePath is required"), "Invalid request")
+		return
+	}
+	folder, filename := req.destination(sourcePath)
+	if filename == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid destinationPath: %s", req.DestinationPath), "Invalid request")
+		return
+	}
+
+	opts, err := parseUploadOptions(map[string]string{
+		"remote":           req.DestinationRemote,
+		"remoteFolder":     folder,
+		"chunkSize":        jsonChunkSize(req.ChunkSize),
+		"conflictBehavior": req.ConflictBehavior,
+		"writeSidecar":     strconv.FormatBool(req.WriteSidecar),
+		"priority":         req.Priority,
+		"expiresIn":        req.ExpiresIn,
+		"splitSize":        req.SplitSize,
+		"shareLink":        req.ShareLink,
+	})
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+	opts.Client = uploadClientKey(r)
+
+	// Look the source up first, so a missing file or a folder is reported right away
+	sourceClient, err := openRemote(r.Context(), req.SourceRemote, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+	sourceFullPath := filepath.Join(rootFolders[req.SourceRemote], sourcePath)
+	source, err := sourceClient.GetItemByPath(r.Context(), http.DefaultClient, sourceFullPath)
+	if err != nil {
+		if isNotFound(err) {
+			sendErrorResponse(w, http.StatusNotFound, err, "Source not found")
+			return
+		}
+		sendErrorResponse(w, http.StatusBadGateway, err, "Failed to fetch source")
+		return
+	}
+	if source.File == nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("%s is not a file", sourcePath), "Only files can be transferred")
+		return
+	}
+	if source.Size > opts.maxFileSize() {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("file size %d exceeds limit of %d bytes", source.Size, opts.maxFileSize()), "Invalid request")
+		return
+	}
+
+	if err := resolveRemote(r.Context(), opts, source.Size); err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			sendErrorResponse(w, http.StatusInsufficientStorage, err, "Insufficient storage")
+			return
+		}
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "No remote available")
+		return
+	}
+	if opts.Remote == req.SourceRemote && filepath.Join(folder, filename) == sourcePath {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("source and destination are the same file"), "Invalid request")
+		return
+	}
+
+	client, releaseQuota, err := claimRemote(r.Context(), opts.Remote, source.Size)
+	if err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			sendErrorResponse(w, http.StatusInsufficientStorage, err, "Insufficient storage")
+			return
+		}
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	store, err := getJobStore()
+	if err != nil {
+		releaseQuota()
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Job store unavailable")
+		return
+	}
+
+	uploadID, err := newUploadID(req.UploadID)
+	if err != nil {
+		releaseQuota()
+		status, message := idError(err, http.StatusBadRequest, "Invalid request")
+		sendErrorResponse(w, status, err, message)
+		return
+	}
+	tracker, err := acquireProgressTracker(uploadID, source.Size)
+	if err != nil {
+		releaseQuota()
+		status, message := idError(err, http.StatusConflict, "Upload ID in use")
+		sendErrorResponse(w, status, err, message)
+		return
+	}
+	w.Header().Set("X-Upload-ID", uploadID)
+
+	// Queue the transfer for a worker on the destination, turning it away if the queue is full
+	ticket, err := getUploadScheduler().schedule(uploadID, opts.Client, opts.Remote, opts.Priority)
+	if err != nil {
+		releaseQuota()
+		tracker.Finish(err)
+		w.Header().Set("Retry-After", retryAfterHeader(queueRetryAfter))
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "Too many uploads, try again later")
+		return
+	}
+
+	job := &Job{
+		ID:           uploadID,
+		State:        JobUploading,
+		Remote:       opts.Remote,
+		RemoteFolder: opts.RemoteFolder,
+		FileName:     filename,
+		FileSize:     source.Size,
+		SourceRemote: req.SourceRemote,
+		SourcePath:   sourcePath,
+		Move:         req.Move,
+		Priority:     opts.Priority.String(),
+	}
+	if err := store.Create(job); err != nil {
+		releaseQuota()
+		ticket.release()
+		tracker.Finish(err)
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to create job")
+		return
+	}
+	log.Printf("Created transfer job %s from %s:%s to %s:%s", job.ID, req.SourceRemote, sourcePath, opts.Remote, filepath.Join(folder, filename))
+
+	// The job outlives the request, so it can only be cancelled explicitly
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker.SetCancel(cancel)
+	tracker.SetPhase(PhaseUploading)
+	go func() {
+		defer cancel()
+		defer ticket.release()
+		if err := waitForJobTurn(ctx, store, job.ID, ticket, tracker, PhaseUploading, JobUploading); err != nil {
+			releaseQuota()
+			return
+		}
+		runTransferJob(ctx, store, job.ID, sourceClient, source, client, releaseQuota, opts, filename, req.Move, tracker)
+	}()
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "accepted",
+		"message":      "Transfer queued",
+		"jobId":        job.ID,
+		"uploadId":     uploadID,
+		"cancelToken":  tracker.CancelToken(),
+		"statusURL":    "/jobs/" + job.ID,
+		"eventsURL":    "/uploads/" + uploadID + "/events",
+		"sourceRemote": job.SourceRemote,
+		"sourcePath":   job.SourcePath,
+		"remote":       job.Remote,
+		"remoteFolder": job.RemoteFolder,
+		"fileName":     job.FileName,
+		"fileSize":     job.FileSize,
+		"move":         job.Move,
+		"priority":     job.Priority,
+	})
+}
+
+// runTransferJob streams the source item into an upload session on the destination and
+// verifies the copy against both the destination's and the source's QuickXorHash.
+// For a move the source is deleted once the copy has been verified. releaseQuota gives back
+// the space claimed on the destination if the transfer fails.
+func runTransferJob(ctx context.Context, store *JobStore, jobID string, sourceClient *azure.AzureClient, source *azure.DriveItem, client *azure.AzureClient, releaseQuota func(), opts *uploadOptions, filename string, move bool, tracker *ProgressTracker) {
+	fail := func(err error) {
+		releaseQuota()
+		err = cancellationError(ctx, err)
+		failJob(store, jobID, err)
+		tracker.Finish(err)
+	}
+
+	// Download URLs are short-lived, so a fresh one is fetched once the job runs
+	item, err := sourceClient.GetItem(ctx, http.DefaultClient, source.ID)
+	if err != nil {
+		fail(fmt.Errorf("failed to fetch source: %w", err))
+		return
+	}
+	if item.DownloadURL == "" {
+		fail(fmt.Errorf("OneDrive returned no download URL for %s", source.Name))
+		return
+	}
+	if item.Size == 0 {
+		fail(fmt.Errorf("file is empty"))
+		return
+	}
+	tracker.SetTotal(item.Size)
+	store.Update(jobID, func(job *Job) {
+		job.FileSize = item.Size
+	})
+
+	body, err := sourceClient.OpenDownload(ctx, http.DefaultClient, item.DownloadURL)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer body.Close()
+
+	spec := &uploadSpec{
+		Remote:       opts.Remote,
+		RemoteFolder: opts.RemoteFolder,
+		Filename:     filename,
+		Size:         item.Size,
+		Checksums:    newChecksumSet(),
+		WriteSidecar: opts.WriteSidecar,
+		ExpiresIn:    opts.ExpiresIn,
+		SplitSize:    opts.SplitSize,
+		ShareLink:    opts.ShareLink,
+		Params: azure.UploadParams{
+			RemoteFilePath: filepath.Join(rootFolders[opts.Remote], opts.RemoteFolder, filename),
+			ChunkSize:      opts.ChunkSize,
+			MaxRetries:     5,
+			RetryDelay:     10 * time.Second,
+			AccessToken:    client.AccessToken,
+
+			ConflictBehavior: opts.ConflictBehavior,
+			Progress:         jobProgress(store, jobID, tracker),
+		},
+		quotaRelease: releaseQuota,
+	}
+	releaseQuota = spec.releaseQuota
+
+	log.Printf("Starting transfer job %s", jobID)
+	received := io.TeeReader(&contextReader{ctx: ctx, r: body}, io.MultiWriter(tracker, spec.Checksums))
+	result, err := completeUpload(ctx, client, spec, received, func() {
+		store.Update(jobID, func(job *Job) {
+			job.State = JobVerifying
+		})
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var sourceHash string
+	if item.File != nil {
+		sourceHash = item.File.Hashes.QuickXorHash
+	}
+	if sourceHash != "" && sourceHash != result.QuickXorHash {
+		if err := client.DeleteItem(ctx, http.DefaultClient, result.FileID); err != nil {
+			log.Printf("Failed to delete mismatched copy %s: %v", result.FileID, err)
+		}
+		fail(fmt.Errorf("%w: source %s, copy %s", errHashMismatch, sourceHash, result.QuickXorHash))
+		return
+	}
+
+	recordJobResult(store, jobID, result)
+	if move {
+		deleteTransferSource(ctx, store, jobID, sourceClient, item, result.Verified && sourceHash != "")
+	}
+	tracker.Finish(nil)
+	log.Printf("Transfer job %s completed: %s", jobID, result.DownloadURL)
+}
+
+// deleteTransferSource deletes the source of a move. The source is kept if the copy could
+// not be verified against both drives' hashes; the job reports why.
+func deleteTransferSource(ctx context.Context, store *JobStore, jobID string, sourceClient *azure.AzureClient, source *azure.DriveItem, verified bool) {
+	var err error
+	if !verified {
+		err = fmt.Errorf("the copy could not be verified, the source was kept")
+	} else {
+		err = sourceClient.DeleteItem(ctx, http.DefaultClient, source.ID)
+	}
+
+	store.Update(jobID, func(job *Job) {
+		job.SourceDeleted = err == nil
+		if err != nil {
+			job.MoveError = err.Error()
+		}
+	})
+	if err != nil {
+		log.Printf("Transfer job %s did not delete its source: %v", jobID, err)
+		return
+	}
+	log.Printf("Transfer job %s deleted its source %s", jobID, source.ID)
+}
@@ -0,0 +1,607 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+// tus protocol constants
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,termination,expiration"
+
+	// OneDrive requires every fragment except the last to be a multiple of 320 KiB
+	tusFragmentSize = 320 * 1024
+	// tusChunkSize is the size of the fragments sent to the upload session (10 MiB)
+	tusChunkSize = 32 * tusFragmentSize
+	// defaultTusUploadExpiry is how long an unfinished upload is kept without receiving data
+	defaultTusUploadExpiry = 24 * time.Hour
+	// tusSweepInterval is how often expired uploads are looked for
+	tusSweepInterval = 5 * time.Minute
+)
+
+// tusUpload tracks a resumable upload and the OneDrive upload session backing it
+type tusUpload struct {
+	ID           string
+	Remote       string
+	RemoteFolder string
+	Filename     string
+	Metadata     string
+	Priority     uploadPriority
+	ExpiresIn    time.Duration
+	ExpiresAt    time.Time // set once the finished upload is scheduled for deletion
+	ShareLink    *shareOptions
+	ShareURL     string // set once the finished upload is shared
+	Length       int64
+	Offset       int64 // bytes received, including pending ones
+	Committed    int64 // bytes OneDrive has acknowledged
+	UploadURL    string
+	DownloadURL  string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time // last time data was received
+
+	client       *azure.AzureClient
+	item         *azure.DriveItem // set once OneDrive has committed the file
+	pending      []byte           // received bytes held back until they fill a 320 KiB fragment
+	releaseQuota func()           // gives back the space claimed for the upload
+
+	// mu is held while an upload receives data, is finished or discarded. The fields HEAD
+	// reports (Offset, UpdatedAt, DownloadURL, ExpiresAt and ShareURL) are only changed
+	// by holders of mu, under state, so HEAD takes state alone and never waits for a PATCH.
+	mu    sync.Mutex
+	state sync.Mutex
+}
+
+// update changes the fields HEAD reports. Callers must hold upload.mu.
+func (upload *tusUpload) update(fn func()) {
+	upload.state.Lock()
+	defer upload.state.Unlock()
+	fn()
+}
+
+// expiresAt returns when the upload is discarded unless it receives more data
+func (upload *tusUpload) expiresAt() time.Time {
+	return upload.UpdatedAt.Add(tusUploadExpiry())
+}
+
+// tusUploadExpiry returns how long unfinished uploads are kept without receiving data,
+// TUS_UPLOAD_EXPIRY
+func tusUploadExpiry() time.Duration {
+	return config.GetEnvDurationWithDefault("TUS_UPLOAD_EXPIRY", defaultTusUploadExpiry)
+}
+
+// tusUploads holds all active tus uploads by ID
+var (
+	tusUploads   = make(map[string]*tusUpload)
+	tusUploadsMu sync.Mutex
+)
+
+// errRandomUnavailable is returned when no random identifier could be generated
+var errRandomUnavailable = errors.New("random source unavailable")
+
+// newID returns a random hex identifier
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%w: %v", errRandomUnavailable, err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// idError returns the status and message for an error from newUploadID or acquireProgressTracker:
+// a server error if no random identifier could be generated, otherwise status and message
+func idError(err error, status int, message string) (int, string) {
+	if errors.Is(err, errRandomUnavailable) {
+		return http.StatusInternalServerError, "Failed to generate upload ID"
+	}
+	return status, message
+}
+
+// parseTusMetadata decodes an Upload-Metadata header into a map
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 1 {
+			metadata[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %s: %v", parts[0], err)
+		}
+		metadata[parts[0]] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// TusHandler implements the tus 1.0 core protocol with the creation, termination and expiration extensions
+func TusHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Upload-Length, Upload-Offset, Upload-Metadata, Tus-Resumable")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Metadata, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Expires, X-Download-URL, X-Remote, X-Expires-At, X-Share-URL")
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	// OPTIONS doubles as the CORS preflight and the tus discovery request
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", TusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxFileSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		sendErrorResponse(w, http.StatusPreconditionFailed, fmt.Errorf("unsupported tus version: %q", r.Header.Get("Tus-Resumable")), "Unsupported tus version")
+		return
+	}
+
+	id := r.PathValue("id")
+	if id == "" {
+		if r.Method != "POST" {
+			sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+			return
+		}
+		tusCreate(w, r)
+		return
+	}
+
+	tusUploadsMu.Lock()
+	upload, ok := tusUploads[id]
+	tusUploadsMu.Unlock()
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, fmt.Errorf("upload %s not found", id), "Upload not found")
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		tusHead(w, upload)
+	case "PATCH":
+		tusPatch(w, r, upload)
+	case "DELETE":
+		tusTerminate(w, r, upload)
+	default:
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+	}
+}
+
+// tusCreate handles the creation extension: it validates the upload and opens a OneDrive upload session
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("Upload-Defer-Length is not supported"), "Invalid request")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid Upload-Length: %q", r.Header.Get("Upload-Length")), "Invalid request")
+		return
+	}
+	if length > MaxFileSize {
+		sendErrorResponse(w, http.StatusRequestEntityTooLarge, fmt.Errorf("file size %d exceeds limit of %d bytes", length, int64(MaxFileSize)), "File too large")
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+
+	remote := metadata["remote"]
+	remoteFolder := metadata["remoteFolder"]
+	filename := metadata["filename"]
+	conflictBehavior := metadata["conflictBehavior"]
+	priority, err := parseUploadPriority(metadata["priority"])
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+	expiresIn, err := parseExpiresIn(metadata["expiresIn"])
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+	shareLink, err := parseShareLink(metadata["shareLink"])
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+
+	// Validate parameters
+	if remote == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("remote is required"), "Invalid request")
+		return
+	}
+
+	if _, ok := rootFolders[remote]; !ok && remote != autoRemote {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+		return
+	}
+
+	if filename == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("filename is required"), "Invalid request")
+		return
+	}
+
+	if err := validateConflictBehavior(conflictBehavior); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to create upload")
+		return
+	}
+
+	// Pick a remote for remote=auto and claim the space before any data is sent
+	if remote == autoRemote {
+		remote, err = getRemoteSelector().selectRemote(r.Context(), length)
+	}
+	var releaseQuota func()
+	if err == nil {
+		releaseQuota, err = claimQuota(r.Context(), remote, length)
+	}
+	if err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			sendErrorResponse(w, http.StatusInsufficientStorage, err, "Insufficient storage")
+			return
+		}
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "No remote available")
+		return
+	}
+
+	client, err := newRemoteClient(remote)
+	if err != nil {
+		releaseQuota()
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	upload := &tusUpload{
+		ID:           id,
+		Remote:       remote,
+		RemoteFolder: remoteFolder,
+		Filename:     filename,
+		Metadata:     r.Header.Get("Upload-Metadata"),
+		Priority:     priority,
+		ExpiresIn:    expiresIn,
+		ShareLink:    shareLink,
+		Length:       length,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		client:       client,
+		releaseQuota: releaseQuota,
+	}
+	remoteFilePath := filepath.Join(rootFolders[remote], remoteFolder, filename)
+
+	// An empty file has no data to PATCH, so it is created and finished right away
+	if length == 0 {
+		params := azure.UploadParams{RemoteFilePath: remoteFilePath, ConflictBehavior: conflictBehavior}
+		upload.item, err = client.UploadFromReader(r.Context(), http.DefaultClient, http.NoBody, 0, params)
+		if err == nil {
+			err = tusComplete(r.Context(), upload)
+		}
+		if err != nil {
+			releaseQuota()
+			if errors.Is(err, azure.ErrConflict) {
+				sendErrorResponse(w, http.StatusConflict, err, "File already exists")
+				return
+			}
+			sendErrorResponse(w, http.StatusBadGateway, err, "Failed to create file")
+			return
+		}
+		w.Header().Set("Location", "/tus/"+upload.ID)
+		w.Header().Set("X-Remote", remote)
+		setTusResultHeaders(w, upload)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	upload.UploadURL, err = client.CreateUploadSession(r.Context(), http.DefaultClient, remoteFilePath, conflictBehavior)
+	if err != nil {
+		releaseQuota()
+		if errors.Is(err, azure.ErrConflict) {
+			sendErrorResponse(w, http.StatusConflict, err, "File already exists")
+			return
+		}
+		sendErrorResponse(w, http.StatusBadGateway, err, "Failed to create upload session")
+		return
+	}
+
+	tusUploadsMu.Lock()
+	tusUploads[upload.ID] = upload
+	tusUploadsMu.Unlock()
+
+	log.Printf("Created tus upload %s for remote: %s, path: %s (%d bytes)", upload.ID, remote, remoteFilePath, length)
+
+	w.Header().Set("Location", "/tus/"+upload.ID)
+	w.Header().Set("X-Remote", remote)
+	w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusHead reports the current offset of an upload. It only takes upload.state, so a client
+// reconnecting after a dropped PATCH gets its offset without waiting for that PATCH to time out.
+func tusHead(w http.ResponseWriter, upload *tusUpload) {
+	upload.state.Lock()
+	defer upload.state.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	if upload.Offset < upload.Length {
+		w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	}
+	if upload.DownloadURL != "" {
+		w.Header().Set("X-Download-URL", upload.DownloadURL)
+	}
+	if !upload.ExpiresAt.IsZero() {
+		w.Header().Set("X-Expires-At", upload.ExpiresAt.Format(time.RFC3339))
+	}
+	if upload.ShareURL != "" {
+		w.Header().Set("X-Share-URL", upload.ShareURL)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch appends the request body to the upload session starting at Upload-Offset.
+// OneDrive only takes fragments that are multiples of tusFragmentSize, so a trailing
+// fragment that is not aligned is held back and sent with the data of the next PATCH.
+func tusPatch(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		sendErrorResponse(w, http.StatusUnsupportedMediaType, fmt.Errorf("invalid Content-Type: %q", r.Header.Get("Content-Type")), "Invalid request")
+		return
+	}
+
+	if !upload.mu.TryLock() {
+		sendErrorResponse(w, http.StatusLocked, fmt.Errorf("upload %s is already receiving data", upload.ID), "Upload locked")
+		return
+	}
+	defer upload.mu.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		sendErrorResponse(w, http.StatusConflict, fmt.Errorf("offset mismatch: expected %d, got %q", upload.Offset, r.Header.Get("Upload-Offset")), "Offset mismatch")
+		return
+	}
+
+	// All data is in, but finalizing the upload failed; try it again
+	if upload.Offset == upload.Length {
+		tusFinish(w, r, upload)
+		return
+	}
+
+	// Each PATCH is scheduled as an upload of its own
+	ticket, err := getUploadScheduler().schedule(upload.ID, uploadClientKey(r), upload.Remote, upload.Priority)
+	if err != nil {
+		w.Header().Set("Retry-After", retryAfterHeader(queueRetryAfter))
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "Too many uploads, try again later")
+		return
+	}
+	defer ticket.release()
+	if err := ticket.wait(r.Context()); err != nil {
+		sendErrorResponse(w, statusClientClosedRequest, err, "Upload cancelled")
+		return
+	}
+
+	limits := getRemoteLimits(upload.Remote)
+	body := io.LimitReader(azure.NewRateLimitedReader(r.Context(), r.Body, limits.receiveLimiters()...), upload.Length-upload.Offset)
+	buf := make([]byte, tusChunkSize)
+	filled := copy(buf, upload.pending)
+	upload.pending = nil
+	for {
+		n, readErr := io.ReadFull(body, buf[filled:])
+		filled += n
+		if n > 0 {
+			upload.update(func() { upload.UpdatedAt = time.Now() })
+		}
+
+		// Send what fills whole fragments, or everything once the upload is complete
+		send := filled
+		if upload.Committed+int64(filled) < upload.Length {
+			send = filled / tusFragmentSize * tusFragmentSize
+		}
+		if send > 0 {
+			start := upload.Committed
+			end := start + int64(send) - 1
+			// A client disconnect aborts the chunk; the upload goes back to what OneDrive acknowledged
+			item, err := upload.client.UploadChunk(r.Context(), http.DefaultClient, upload.UploadURL, buf[:send], start, end, upload.Length)
+			if err != nil {
+				upload.update(func() { upload.Offset = upload.Committed })
+				if errors.Is(err, azure.ErrConflict) {
+					sendErrorResponse(w, http.StatusConflict, err, "File already exists")
+					return
+				}
+				sendErrorResponse(w, http.StatusBadGateway, err, "Failed to upload chunk")
+				return
+			}
+			upload.Committed = end + 1
+			if item != nil {
+				upload.item = item
+			}
+			filled = copy(buf, buf[send:filled])
+		}
+		upload.update(func() { upload.Offset = upload.Committed + int64(filled) })
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			// Keep what was received so the client can resume from it
+			log.Printf("tus upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, readErr)
+			break
+		}
+	}
+	// The unaligned tail waits for the next PATCH
+	if filled > 0 {
+		upload.pending = append([]byte(nil), buf[:filled]...)
+	}
+
+	if upload.Offset == upload.Length {
+		tusFinish(w, r, upload)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusFinish completes an upload that has received all its data and answers the PATCH with
+// the file's URLs
+func tusFinish(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	if err := tusComplete(r.Context(), upload); err != nil {
+		sendErrorResponse(w, http.StatusBadGateway, err, "Failed to finalize upload")
+		return
+	}
+	setTusResultHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setTusResultHeaders sets the headers describing a finished upload
+func setTusResultHeaders(w http.ResponseWriter, upload *tusUpload) {
+	w.Header().Set("X-Download-URL", upload.DownloadURL)
+	if !upload.ExpiresAt.IsZero() {
+		w.Header().Set("X-Expires-At", upload.ExpiresAt.Format(time.RFC3339))
+	}
+	if upload.ShareURL != "" {
+		w.Header().Set("X-Share-URL", upload.ShareURL)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+}
+
+// tusComplete records the download URL of a finished upload, using the name OneDrive assigned,
+// and forgets the upload
+func tusComplete(ctx context.Context, upload *tusUpload) error {
+	if upload.item == nil {
+		remoteFilePath := filepath.Join(rootFolders[upload.Remote], upload.RemoteFolder, upload.Filename)
+		fileID, err := upload.client.GetFileID(ctx, http.DefaultClient, remoteFilePath)
+		if err != nil {
+			return err
+		}
+		upload.item, err = upload.client.GetItem(ctx, http.DefaultClient, fileID)
+		if err != nil {
+			return err
+		}
+	}
+
+	downloadURL := buildDownloadURL(upload.Remote, upload.RemoteFolder, upload.item.Name)
+	upload.update(func() { upload.DownloadURL = downloadURL })
+	log.Printf("tus upload %s completed: %s", upload.ID, upload.DownloadURL)
+
+	if upload.ExpiresIn > 0 && upload.ExpiresAt.IsZero() {
+		spec := &uploadSpec{Remote: upload.Remote, RemoteFolder: upload.RemoteFolder, ExpiresIn: upload.ExpiresIn}
+		result := &uploadResult{FileID: upload.item.ID, FileName: upload.item.Name, DownloadURL: upload.DownloadURL}
+		scheduleUploadExpiry(spec, result, "")
+		upload.update(func() { upload.ExpiresAt = result.ExpiresAt })
+	}
+	if upload.ShareLink != nil && upload.ShareURL == "" {
+		spec := &uploadSpec{ShareLink: upload.ShareLink}
+		result := &uploadResult{FileID: upload.item.ID, FileName: upload.item.Name}
+		shareUpload(ctx, upload.client, spec, result)
+		upload.update(func() { upload.ShareURL = result.ShareURL })
+	}
+
+	tusUploadsMu.Lock()
+	delete(tusUploads, upload.ID)
+	tusUploadsMu.Unlock()
+	return nil
+}
+
+// tusTerminate handles the termination extension by discarding the upload session
+func tusTerminate(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	tusDiscard(r.Context(), upload)
+	log.Printf("Terminated tus upload %s", upload.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDiscard forgets an upload and, unless it is complete, cancels its upload session and
+// gives back the space claimed for it. Callers must hold upload.mu.
+func tusDiscard(ctx context.Context, upload *tusUpload) {
+	if upload.Committed < upload.Length {
+		if err := upload.client.CancelUploadSession(ctx, http.DefaultClient, upload.UploadURL); err != nil {
+			log.Printf("Failed to cancel upload session for tus upload %s: %v", upload.ID, err)
+		}
+		upload.releaseQuota()
+	}
+	upload.pending = nil
+
+	tusUploadsMu.Lock()
+	delete(tusUploads, upload.ID)
+	tusUploadsMu.Unlock()
+}
+
+// StartTusJanitor starts the goroutine that discards uploads which have not received data
+// for TUS_UPLOAD_EXPIRY, until ctx is done
+func StartTusJanitor(ctx context.Context) {
+	interval := min(tusUploadExpiry(), tusSweepInterval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepTusUploads(ctx, time.Now())
+			}
+		}
+	}()
+}
+
+// sweepTusUploads discards every upload that expired before now. Uploads receiving data are
+// left alone.
+func sweepTusUploads(ctx context.Context, now time.Time) {
+	tusUploadsMu.Lock()
+	uploads := make([]*tusUpload, 0, len(tusUploads))
+	for _, upload := range tusUploads {
+		uploads = append(uploads, upload)
+	}
+	tusUploadsMu.Unlock()
+
+	for _, upload := range uploads {
+		if !upload.mu.TryLock() {
+			continue
+		}
+		if upload.expiresAt().Before(now) {
+			tusDiscard(ctx, upload)
+			log.Printf("Discarded tus upload %s, idle since %s", upload.ID, upload.UpdatedAt.Format(time.RFC3339))
+		}
+		upload.mu.Unlock()
+	}
+}
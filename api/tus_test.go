@@ -0,0 +1,57 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", header: "", want: map[string]string{}},
+		{
+			name:   "pairs",
+			header: "filename d29ybGRfZG9taW5hdGlvbi5wZGY=,filetype YXBwbGljYXRpb24vcGRm",
+			want:   map[string]string{"filename": "world_domination.pdf", "filetype": "application/pdf"},
+		},
+		{
+			name:   "key without a value",
+			header: "filename aGVsbG8udHh0, is_confidential",
+			want:   map[string]string{"filename": "hello.txt", "is_confidential": ""},
+		},
+		{
+			name:   "empty pairs are skipped",
+			header: " ,filename aGVsbG8udHh0,, ",
+			want:   map[string]string{"filename": "hello.txt"},
+		},
+		{
+			name:   "empty value",
+			header: "remoteFolder ",
+			want:   map[string]string{"remoteFolder": ""},
+		},
+		{name: "value not base64", header: "filename hello.txt", wantErr: true},
+		{name: "unpadded value", header: "filename aGVsbG8", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTusMetadata(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseTusMetadata(%q) = %v, want an error", tt.header, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTusMetadata(%q) failed: %v", tt.header, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTusMetadata(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
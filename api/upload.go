@@ -1,14 +1,21 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -99,7 +106,7 @@ func TokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Ensure token is refreshed if needed
-	if err := client.EnsureTokenValid(http.DefaultClient); err != nil {
+	if err := client.EnsureTokenValid(r.Context(), http.DefaultClient); err != nil {
 		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to refresh token")
 		return
 	}
@@ -139,10 +146,40 @@ var baseURLs = map[string]string{
 	"saurajcf":       "https://my-index-azure.vercel.app",
 }
 
+// statusClientClosedRequest reports an upload cancelled before it completed
+const statusClientClosedRequest = 499
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Details string `json:"details,omitempty"`
+	Error            string   `json:"error"`
+	Code             string   `json:"code,omitempty"`
+	Details          string   `json:"details,omitempty"`
+	AttemptedRemotes []string `json:"attemptedRemotes,omitempty"`
+}
+
+// errHashMismatch is returned when the uploaded file's QuickXorHash differs from the one computed locally
+var errHashMismatch = errors.New("quickXorHash mismatch")
+
+// errorCode returns a machine readable code for errors clients may want to handle
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errHashMismatch):
+		return "HASH_MISMATCH"
+	case errors.Is(err, errChecksumMismatch):
+		return "CHECKSUM_MISMATCH"
+	case errors.Is(err, azure.ErrConflict):
+		return "CONFLICT"
+	case errors.Is(err, errSourceNotAllowed):
+		return "SOURCE_NOT_ALLOWED"
+	case errors.Is(err, context.Canceled):
+		return "CANCELLED"
+	case errors.Is(err, errUploadQueueFull):
+		return "QUEUE_FULL"
+	case errors.Is(err, errInsufficientStorage):
+		return "INSUFFICIENT_STORAGE"
+	default:
+		return ""
+	}
 }
 
 // sendErrorResponse sends a JSON error response
@@ -151,8 +188,10 @@ func sendErrorResponse(w http.ResponseWriter, statusCode int, err error, message
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(ErrorResponse{
-		Error:   message,
-		Details: err.Error(),
+		Error:            message,
+		Code:             errorCode(err),
+		Details:          err.Error(),
+		AttemptedRemotes: attemptedRemotes(err),
 	})
 }
 
@@ -174,7 +213,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Filename, "+uploadOptionHeaderList())
+	w.Header().Set("Access-Control-Expose-Headers", "Location, X-Upload-ID")
 
 	// Handle preflight requests
 	if r.Method == "OPTIONS" {
@@ -188,168 +228,1165 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Getting embedded config data...")
-	// Get embedded config data
-	configData := config.GetRcloneConfig()
-
 	var (
-		err           error
-		remote        string
-		remoteFolder  string
-		filename      string
-		chunkSizeStr  string
-		file          io.ReadCloser
-		contentLength int64
+		err      error
+		fields   map[string]string
+		first    *fileUpload
+		reader   *multipart.Reader
+		filePart *multipart.Part // nil in binary mode
 	)
 
 	contentType := r.Header.Get("Content-Type")
-	if contentType == "application/octet-stream" {
-		// Binary upload mode
-		remote = r.Header.Get("X-Remote")
-		remoteFolder = r.Header.Get("X-Remote-Folder")
-		filename = r.Header.Get("X-Filename")
-		chunkSizeStr = r.Header.Get("X-Chunk-Size")
-		file = r.Body
-		contentLength = r.ContentLength
+	binaryMode := contentType == "application/octet-stream"
+	if binaryMode {
+		// Binary upload mode, options are passed as headers
+		fields = make(map[string]string, len(uploadOptionHeaders))
+		for field, header := range uploadOptionHeaders {
+			fields[field] = r.Header.Get(header)
+		}
+		first = &fileUpload{
+			Filename: r.Header.Get("X-Filename"),
+			Body:     r.Body,
+			Size:     r.ContentLength,
+		}
 	} else {
-		// Traditional form upload mode
-		err = r.ParseMultipartForm(10 << 20) // 10MB for form data
+		// Traditional form upload mode, read as a stream so files are never
+		// spooled by ParseMultipartForm. Form fields must precede the file parts.
+		reader, err = r.MultipartReader()
 		if err != nil {
 			sendErrorResponse(w, http.StatusBadRequest, err, "Unable to parse form data")
 			return
 		}
-		defer r.MultipartForm.RemoveAll()
 
-		remote = r.FormValue("remote")
-		remoteFolder = r.FormValue("remoteFolder")
-		chunkSizeStr = r.FormValue("chunkSize")
-
-		uploadedFile, header, err := r.FormFile("file")
+		fields, filePart, err = readMultipartFields(reader)
 		if err != nil {
 			sendErrorResponse(w, http.StatusBadRequest, err, "Unable to read file")
 			return
 		}
-		defer uploadedFile.Close()
+		if filePart == nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("no file part found in form data"), "Unable to read file")
+			return
+		}
+		defer filePart.Close()
+
+		// The request size cap is raised for split uploads before the body is read, so
+		// split mode can only be asked for with the header
+		if fields["splitSize"] != "" {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("the splitSize form field is not supported, send the X-Split-Size header instead"), "Invalid request")
+			return
+		}
+		fields["splitSize"] = r.Header.Get(uploadOptionHeaders["splitSize"])
 
-		file = uploadedFile
-		filename = header.Filename
-		contentLength = header.Size
+		first = &fileUpload{
+			Filename: filePart.FileName(),
+			Body:     filePart,
+		}
 	}
 
-	// Validate parameters
-	if remote == "" {
-		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("remote is required"), "Invalid request")
+	opts, err := parseUploadOptions(fields)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
 		return
 	}
 
-	if _, ok := rootFolders[remote]; !ok {
-		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid remote: %s", remote), "Invalid request")
+	if err := first.applyFields(fields, filePart, opts.maxFileSize()); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
 		return
 	}
 
-	if filename == "" {
-		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("filename is required"), "Invalid request")
+	// Pick a remote for remote=auto
+	if err := resolveRemote(r.Context(), opts, r.ContentLength); err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			sendErrorResponse(w, http.StatusInsufficientStorage, err, "Insufficient storage")
+			return
+		}
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "No remote available")
 		return
 	}
 
-	if chunkSizeStr == "" {
-		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("chunk size is required"), "Invalid request")
+	log.Printf("Initializing Azure client...")
+	// Initialize AzureClient for the remote configuration, shared by all files in the request.
+	// The token is refreshed once for the whole batch, and uploads that cannot fit are turned
+	// away before reading them; either moves the request on to the remote's failover chain.
+	client, err := connectRemote(r.Context(), opts, r.ContentLength)
+	if err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			sendErrorResponse(w, http.StatusInsufficientStorage, err, "Insufficient storage")
+			return
+		}
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
 		return
 	}
 
+	opts.Client = uploadClientKey(r)
+
+	// Files upload in the background while the request is read; the response waits for all of them
+	batch := &uploadBatch{}
+	outcome := processFile(r.Context(), client, opts, first, batch)
+	if binaryMode {
+		batch.wait()
+		writeFileOutcome(w, outcome)
+		return
+	}
+
+	// Any further file parts are scheduled as they are read
+	outcomes := []*fileOutcome{outcome}
+	for {
+		perFile, part, err := readMultipartFields(reader)
+		if err != nil {
+			log.Printf("Stopped reading form data: %v", err)
+			outcomes = append(outcomes, &fileOutcome{
+				StatusCode: http.StatusBadRequest,
+				Err:        err,
+				Message:    "Unable to read file",
+			})
+			break
+		}
+		if part == nil {
+			break
+		}
+
+		file := &fileUpload{
+			Filename: part.FileName(),
+			Body:     part,
+		}
+		if err := file.applyFields(perFile, part, opts.maxFileSize()); err != nil {
+			outcomes = append(outcomes, &fileOutcome{
+				StatusCode: http.StatusBadRequest,
+				FileName:   file.Filename,
+				Err:        err,
+				Message:    "Invalid request",
+			})
+			part.Close()
+			continue
+		}
+		for name := range perFile {
+			if !perFileFields[name] {
+				log.Printf("Ignoring form field %s after the first file", name)
+			}
+		}
+
+		outcomes = append(outcomes, processFile(r.Context(), client, opts, file, batch))
+		part.Close()
+	}
+	batch.wait()
+
+	if len(outcomes) == 1 {
+		writeFileOutcome(w, outcome)
+		return
+	}
+	writeBatchResponse(w, outcomes)
+}
+
+// uploadOptions are the settings shared by every file in an upload request
+type uploadOptions struct {
+	Remote           string
+	RemoteFolder     string
+	ChunkSize        int64
+	ConflictBehavior string
+	Async            bool
+	WriteSidecar     bool
+	Priority         uploadPriority
+	Client           string        // identifies the client for fair scheduling
+	Fallbacks        []string      // remotes to fail over to, set by connectRemote
+	Attempted        []string      // remotes given up on before the upload started
+	ReplicateTo      []string      // remotes the file is copied to once uploaded
+	ExpiresIn        time.Duration // delete the file after this long, 0 to keep it
+	SplitSize        int64         // store the file as parts of this size, 0 to store it whole
+	ShareLink        *shareOptions // sharing link to create once uploaded, nil for none
+}
+
+// maxFileSize returns the largest file the options accept
+func (opts *uploadOptions) maxFileSize() int64 {
+	if opts.SplitSize > 0 {
+		return MaxSplitFileSize()
+	}
+	return MaxFileSize
+}
+
+// defaultJSONChunkSize is the chunk size in MB used when a JSON request leaves chunkSize out
+const defaultJSONChunkSize = 8
+
+// jsonChunkSize returns a JSON request's chunk size in MB as an upload form field
+func jsonChunkSize(mb int64) string {
+	if mb == 0 {
+		mb = defaultJSONChunkSize
+	}
+	return strconv.FormatInt(mb, 10)
+}
+
+// parseUploadOptions validates the request wide upload settings
+func parseUploadOptions(fields map[string]string) (*uploadOptions, error) {
+	opts := &uploadOptions{
+		Remote:           fields["remote"],
+		RemoteFolder:     fields["remoteFolder"],
+		ConflictBehavior: fields["conflictBehavior"],
+	}
+
+	// Validate parameters
+	if opts.Remote == "" {
+		return nil, fmt.Errorf("remote is required")
+	}
+
+	if _, ok := rootFolders[opts.Remote]; !ok && opts.Remote != autoRemote {
+		return nil, fmt.Errorf("invalid remote: %s", opts.Remote)
+	}
+
+	chunkSizeStr := fields["chunkSize"]
+	if chunkSizeStr == "" {
+		return nil, fmt.Errorf("chunk size is required")
+	}
+
 	chunkSize, err := strconv.ParseInt(chunkSizeStr, 10, 64)
 	if err != nil || chunkSize < 2 || chunkSize > 32 {
-		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid chunk size: must be between 2 and 32"), "Invalid request")
-		return
+		return nil, fmt.Errorf("invalid chunk size: must be between 2 and 32")
 	}
-	chunkSize *= 1024 * 1024 // Convert MB to bytes
+	opts.ChunkSize = chunkSize * 1024 * 1024 // Convert MB to bytes
 
-	log.Printf("Initializing Azure client...")
-	// Initialize AzureClient for the remote configuration
-	client, err := azure.NewAzureClientFromRcloneConfigData(configData, remote)
+	if err := validateConflictBehavior(opts.ConflictBehavior); err != nil {
+		return nil, err
+	}
+
+	opts.Priority, err = parseUploadPriority(fields["priority"])
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
-		return
+		return nil, err
 	}
 
-	log.Printf("Processing upload for remote: %s, folder: %s, file: %s", remote, remoteFolder, filename)
+	opts.ReplicateTo, err = parseReplicaRemotes(fields["replicateTo"])
+	if err != nil {
+		return nil, err
+	}
 
-	// Create a temporary file with a meaningful prefix
-	tempFile, err := os.CreateTemp("", fmt.Sprintf("upload-%s-*.tmp", filepath.Base(filename)))
+	opts.ExpiresIn, err = parseExpiresIn(fields["expiresIn"])
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to create temp file")
-		return
+		return nil, err
 	}
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempFile.Name())
-		log.Printf("Cleaned up temporary file: %s", tempFile.Name())
-	}()
 
-	// Copy the file content with progress tracking
-	log.Printf("Copying file content...")
-	written, err := io.Copy(tempFile, io.TeeReader(file, &progressWriter{
-		total:     contentLength,
-		processed: 0,
-	}))
+	opts.SplitSize, err = parseSplitSize(fields["splitSize"])
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to save file")
+		return nil, err
+	}
+	if opts.SplitSize > 0 && len(opts.ReplicateTo) > 0 {
+		return nil, fmt.Errorf("splitSize cannot be combined with replicateTo")
+	}
+
+	opts.ShareLink, err = parseShareLink(fields["shareLink"])
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Async, _ = strconv.ParseBool(fields["async"])
+	opts.WriteSidecar, _ = strconv.ParseBool(fields["writeSidecar"])
+
+	return opts, nil
+}
+
+// perFileFields are the form fields that only apply to the file part following them
+var perFileFields = map[string]bool{
+	"fileSize": true,
+	"uploadId": true,
+	"sha256":   true,
+	"sha1":     true,
+	"md5":      true,
+}
+
+// fileUpload is a single file in an upload request
+type fileUpload struct {
+	Filename          string
+	Body              io.Reader
+	Size              int64 // -1 if unknown
+	UploadID          string
+	ExpectedChecksums map[string]string
+}
+
+// applyFields reads the per-file settings. In multipart mode the size comes from the
+// part's Content-Length header or a preceding fileSize field.
+func (f *fileUpload) applyFields(fields map[string]string, part *multipart.Part, maxSize int64) error {
+	f.UploadID = fields["uploadId"]
+
+	if part != nil {
+		f.Size = -1
+		sizeStr := part.Header.Get("Content-Length")
+		if sizeStr == "" {
+			sizeStr = fields["fileSize"]
+		}
+		if sizeStr != "" {
+			size, err := strconv.ParseInt(sizeStr, 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("invalid fileSize: %s", sizeStr)
+			}
+			f.Size = size
+		}
+	}
+
+	if f.Filename == "" {
+		return fmt.Errorf("filename is required")
+	}
+
+	if f.Size > maxSize {
+		return fmt.Errorf("file size %d exceeds limit of %d bytes", f.Size, maxSize)
+	}
+
+	var err error
+	f.ExpectedChecksums, err = parseExpectedChecksums(fields)
+	return err
+}
+
+// fileOutcome is the result of processing a single file
+type fileOutcome struct {
+	StatusCode int
+	FileName   string
+	UploadID   string
+	JobID      string
+	Response   map[string]interface{} // set on success
+	Err        error
+	Message    string
+	RetryAfter time.Duration // sent as Retry-After with the error
+}
+
+// writeFileOutcome writes the response for a single file upload
+func writeFileOutcome(w http.ResponseWriter, outcome *fileOutcome) {
+	if outcome.UploadID != "" {
+		w.Header().Set("X-Upload-ID", outcome.UploadID)
+	}
+	if outcome.Err != nil {
+		if outcome.RetryAfter > 0 {
+			w.Header().Set("Retry-After", retryAfterHeader(outcome.RetryAfter))
+		}
+		sendErrorResponse(w, outcome.StatusCode, outcome.Err, outcome.Message)
 		return
 	}
-	log.Printf("Copied %d bytes to temporary file", written)
+
+	if outcome.JobID != "" {
+		w.Header().Set("Location", "/jobs/"+outcome.JobID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(outcome.StatusCode)
+	json.NewEncoder(w).Encode(outcome.Response)
+}
+
+// writeBatchResponse writes the per-file results of a multi-file upload
+func writeBatchResponse(w http.ResponseWriter, outcomes []*fileOutcome) {
+	results := make([]map[string]interface{}, 0, len(outcomes))
+	failed := 0
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			failed++
+			result := map[string]interface{}{
+				"status":     "error",
+				"statusCode": outcome.StatusCode,
+				"fileName":   outcome.FileName,
+				"error":      outcome.Message,
+				"details":    outcome.Err.Error(),
+			}
+			if attempted := attemptedRemotes(outcome.Err); attempted != nil {
+				result["attemptedRemotes"] = attempted
+			}
+			if outcome.UploadID != "" {
+				result["uploadId"] = outcome.UploadID
+			}
+			if code := errorCode(outcome.Err); code != "" {
+				result["code"] = code
+			}
+			results = append(results, result)
+			continue
+		}
+		result := make(map[string]interface{}, len(outcome.Response)+1)
+		for key, value := range outcome.Response {
+			result[key] = value
+		}
+		result["statusCode"] = outcome.StatusCode
+		results = append(results, result)
+	}
+
+	status := "success"
+	statusCode := http.StatusOK
+	if failed == 0 && outcomes[0].StatusCode == http.StatusAccepted {
+		// Async batches are accepted, not yet uploaded
+		statusCode = http.StatusAccepted
+	}
+	switch {
+	case failed == len(outcomes):
+		status = "error"
+		statusCode = outcomes[0].StatusCode
+		if outcomes[0].RetryAfter > 0 {
+			w.Header().Set("Retry-After", retryAfterHeader(outcomes[0].RetryAfter))
+		}
+	case failed > 0:
+		status = "partial"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    status,
+		"message":   fmt.Sprintf("%d of %d files uploaded", len(outcomes)-failed, len(outcomes)),
+		"succeeded": len(outcomes) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// processFile uploads a single file, either streaming it to OneDrive or,
+// for async uploads, receiving it and handing it to a background job.
+// Sync uploads run in the background of batch; the returned outcome is filled in
+// once batch.wait returns. The upload stops when ctx is done or it is cancelled
+// through DELETE /uploads/{id}.
+func processFile(ctx context.Context, client *azure.AzureClient, opts *uploadOptions, file *fileUpload, batch *uploadBatch) *fileOutcome {
+	outcome := &fileOutcome{FileName: file.Filename}
+
+	log.Printf("Processing upload for remote: %s, folder: %s, file: %s", opts.Remote, opts.RemoteFolder, file.Filename)
 
 	// Construct the remote file path
-	remoteFilePath := filepath.Join(rootFolders[remote], remoteFolder, filename)
+	remoteFilePath := filepath.Join(rootFolders[opts.Remote], opts.RemoteFolder, file.Filename)
 	log.Printf("Remote file path: %s", remoteFilePath)
 
-	// Upload parameters with sequential chunk upload
-	params := azure.UploadParams{
-		FilePath:       tempFile.Name(),
-		RemoteFilePath: remoteFilePath,
-		ChunkSize:      chunkSize,
-		ParallelChunks: 1,                // Disable parallel uploads to avoid eTag conflicts
-		MaxRetries:     5,                // Increase retries
-		RetryDelay:     10 * time.Second, // Increase delay between retries
-		AccessToken:    client.AccessToken,
+	spec := &uploadSpec{
+		Remote:       opts.Remote,
+		RemoteFolder: opts.RemoteFolder,
+		Filename:     file.Filename,
+		Size:         file.Size,
+		Checksums:    newChecksumSet(),
+		WriteSidecar: opts.WriteSidecar,
+		Fallbacks:    opts.Fallbacks,
+		Attempted:    opts.Attempted,
+		ExpiresIn:    opts.ExpiresIn,
+		SplitSize:    opts.SplitSize,
+		ShareLink:    opts.ShareLink,
+		// Chunks of a session are sent in order; files are uploaded in parallel instead
+		Params: azure.UploadParams{
+			RemoteFilePath: remoteFilePath,
+			ChunkSize:      opts.ChunkSize,
+			MaxRetries:     5,                // Increase retries
+			RetryDelay:     10 * time.Second, // Increase delay between retries
+			AccessToken:    client.AccessToken,
+
+			ConflictBehavior: opts.ConflictBehavior,
+		},
 	}
 
-	// Upload the file to OneDrive
-	log.Printf("Starting OneDrive upload...")
-	_, err = client.Upload(http.DefaultClient, params)
+	// Track progress under a client supplied or generated upload ID
+	uploadID, err := newUploadID(file.UploadID)
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to upload file")
-		return
+		outcome.Err = err
+		outcome.StatusCode, outcome.Message = idError(err, http.StatusBadRequest, "Invalid request")
+		return outcome
+	}
+	tracker, err := acquireProgressTracker(uploadID, file.Size)
+	if err != nil {
+		outcome.Err = err
+		outcome.StatusCode, outcome.Message = idError(err, http.StatusConflict, "Upload ID in use")
+		return outcome
 	}
-	log.Printf("File uploaded successfully")
+	outcome.UploadID = uploadID
 
-	// Generate the download URL
-	baseURL := baseURLs[remote]
-	downloadURL := fmt.Sprintf("%s/%s/%s", baseURL, remoteFolder, filename)
+	ctx, cancel := context.WithCancel(ctx)
+	tracker.SetCancel(cancel)
 
-	// Return success response
-	response := map[string]interface{}{
-		"status":      "success",
-		"message":     "File uploaded successfully",
-		"downloadURL": downloadURL,
-		"fileSize":    written,
-		"fileName":    filename,
+	// Queue the upload for a worker, turning it away if the remote's queue is full
+	ticket, err := getUploadScheduler().schedule(uploadID, opts.Client, opts.Remote, opts.Priority)
+	if err != nil {
+		cancel()
+		tracker.Finish(err)
+		outcome.StatusCode, outcome.Err, outcome.Message = http.StatusServiceUnavailable, err, "Too many uploads, try again later"
+		outcome.RetryAfter = queueRetryAfter
+		return outcome
 	}
+	spec.ticket = ticket
+	// The ticket and context pass to the background upload once it starts
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			ticket.release()
+			cancel()
+		}
+	}()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	log.Printf("Request completed successfully")
+	var (
+		store    *JobStore
+		job      *Job
+		tempFile *os.File
+		body     io.Reader
+		size     = file.Size
+	)
+
+	// fail records an error for the client and for everything tracking this upload
+	fail := func(statusCode int, err error, message string) *fileOutcome {
+		if ctx.Err() != nil {
+			statusCode, err, message = statusClientClosedRequest, cancellationError(ctx, err), "Upload cancelled"
+		}
+		spec.releaseQuota()
+		if tempFile != nil {
+			removeTempFile(tempFile)
+		}
+		if job != nil {
+			failJob(store, job.ID, err)
+		}
+		tracker.Finish(err)
+		outcome.StatusCode, outcome.Err, outcome.Message = statusCode, err, message
+		return outcome
+	}
+
+	// Space for files of known size is claimed before anything is received
+	if size >= 0 {
+		release, err := claimQuota(ctx, opts.Remote, size)
+		if err != nil {
+			return fail(http.StatusInsufficientStorage, err, "Insufficient storage")
+		}
+		spec.quotaRelease = release
+	}
+
+	// Async uploads are received in full before the job is handed to the background.
+	// Uploads with replicas get a job too, which tracks the replicas once the upload is done.
+	if opts.Async || len(opts.ReplicateTo) > 0 {
+		store, err = getJobStore()
+		if err != nil {
+			return fail(http.StatusInternalServerError, err, "Job store unavailable")
+		}
+
+		job = &Job{
+			ID:           uploadID,
+			State:        JobReceiving,
+			Remote:       opts.Remote,
+			RemoteFolder: opts.RemoteFolder,
+			FileName:     file.Filename,
+			FileSize:     size,
+			Priority:     opts.Priority.String(),
+		}
+		if err := store.Create(job); err != nil {
+			job = nil
+			return fail(http.StatusInternalServerError, err, "Unable to create job")
+		}
+		log.Printf("Created upload job %s", job.ID)
+	}
+
+	// OneDrive needs the total size up front, so bodies of unknown length
+	// (chunked requests, multipart without fileSize) are spooled to disk first.
+	// Async uploads are spooled so the request can return once the body is received,
+	// and uploads with client checksums so nothing is sent before they are verified.
+	// While an earlier file of the request is still uploading the next one is spooled
+	// too, so the request can read on and both upload in parallel. Uploads to a remote
+	// with a failover chain or replicas are spooled so they can be sent again.
+	spool := size < 0 || opts.Async || len(file.ExpectedChecksums) > 0 || batch.busy() ||
+		len(opts.Fallbacks) > 0 || len(opts.ReplicateTo) > 0
+
+	// A streamed body is read by the background upload; the request moves on once it is consumed
+	var consumed chan struct{}
+	if !spool {
+		consumed = make(chan struct{})
+		file.Body = &handoffReader{r: file.Body, done: consumed}
+	}
+
+	// Digests are computed as the body is received, within the bandwidth limits
+	limited := azure.NewRateLimitedReader(ctx, &contextReader{ctx: ctx, r: file.Body}, getRemoteLimits(opts.Remote).receiveLimiters()...)
+	received := io.TeeReader(limited, io.MultiWriter(tracker, spec.Checksums))
+
+	if spool {
+		log.Printf("Spooling upload to temporary file...")
+		spooled, spooledSize, err := spoolToTempFile(received, file.Filename, opts.maxFileSize())
+		if err != nil {
+			return fail(http.StatusInternalServerError, err, "Unable to save file")
+		}
+		tempFile = spooled
+		if size >= 0 && spooledSize != size {
+			return fail(http.StatusBadRequest, fmt.Errorf("received %d bytes, expected %d", spooledSize, size), "Incomplete upload")
+		}
+		if err := verifyChecksums(file.ExpectedChecksums, spec.Checksums.Digests()); err != nil {
+			return fail(http.StatusUnprocessableEntity, err, "Checksum mismatch")
+		}
+		if size < 0 {
+			release, err := claimQuota(ctx, opts.Remote, spooledSize)
+			if err != nil {
+				return fail(http.StatusInsufficientStorage, err, "Insufficient storage")
+			}
+			spec.quotaRelease = release
+		}
+		body = tempFile
+		size = spooledSize
+		spec.Size = size
+		tracker.SetTotal(size)
+	} else {
+		// Streamed bodies are received and uploaded at the same time
+		body = received
+	}
+
+	if size == 0 {
+		return fail(http.StatusBadRequest, fmt.Errorf("file is empty"), "Invalid request")
+	}
+
+	if opts.Async {
+		store.Update(job.ID, func(job *Job) {
+			job.FileSize = size
+			job.Checksums = spec.Checksums.Digests()
+		})
+		tracker.SetPhase(PhaseUploading)
+		// The job outlives the request, so it can only be cancelled explicitly
+		jobCtx, cancelJob := context.WithCancel(context.Background())
+		tracker.SetCancel(cancelJob)
+		handedOff = true
+		cancel()
+		go func() {
+			defer cancelJob()
+			defer ticket.release()
+			if err := waitForJobTurn(jobCtx, store, job.ID, ticket, tracker, PhaseUploading, JobUploading); err != nil {
+				spec.releaseQuota()
+				removeTempFile(tempFile)
+				return
+			}
+			result := runUploadJob(jobCtx, store, job.ID, client, spec, tempFile, tracker)
+			if result != nil && len(opts.ReplicateTo) > 0 {
+				startReplication(store, job.ID, opts, spec, result, tempFile)
+				return
+			}
+			removeTempFile(tempFile)
+		}()
+
+		outcome.StatusCode = http.StatusAccepted
+		outcome.JobID = job.ID
+		outcome.Response = map[string]interface{}{
+			"status":      "accepted",
+			"message":     "File received, upload queued",
+			"jobId":       job.ID,
+			"uploadId":    uploadID,
+			"cancelToken": tracker.CancelToken(),
+			"statusURL":   "/jobs/" + job.ID,
+			"eventsURL":   "/uploads/" + uploadID + "/events",
+			"fileSize":    size,
+			"fileName":    file.Filename,
+			"remote":      opts.Remote,
+			"priority":    opts.Priority.String(),
+			"checksums":   spec.Checksums.Digests(),
+		}
+		if len(opts.ReplicateTo) > 0 {
+			outcome.Response["replicateTo"] = opts.ReplicateTo
+		}
+		return outcome
+	}
+
+	upload := func() {
+		defer cancel()
+		defer ticket.release()
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Panic recovered in upload %s: %v", uploadID, err)
+				fail(http.StatusInternalServerError, fmt.Errorf("%v", err), "Internal server error")
+			}
+		}()
+
+		// A streamed body is only read once a worker is free
+		if err := waitForTurn(ctx, ticket, tracker, PhaseUploading); err != nil {
+			fail(http.StatusServiceUnavailable, err, "Upload queue unavailable")
+			return
+		}
+
+		// Stream the body to OneDrive, one chunk at a time
+		log.Printf("Starting OneDrive upload...")
+		tracker.SetPhase(PhaseUploading)
+		if job != nil {
+			store.Update(job.ID, func(job *Job) {
+				job.State = JobUploading
+				job.FileSize = size
+			})
+		}
+		spec.Params.Progress = tracker.UploadProgress
+		result, err := completeUpload(ctx, client, spec, body, nil)
+		if err != nil {
+			if errors.Is(err, errHashMismatch) {
+				fail(http.StatusBadGateway, err, "Upload verification failed")
+				return
+			}
+			if errors.Is(err, azure.ErrConflict) {
+				fail(http.StatusConflict, err, "File already exists")
+				return
+			}
+			fail(http.StatusInternalServerError, err, "Failed to upload file")
+			return
+		}
+		var replicas []string
+		if job != nil {
+			recordJobResult(store, job.ID, result)
+			replicas = startReplication(store, job.ID, opts, spec, result, tempFile)
+		} else if tempFile != nil {
+			removeTempFile(tempFile)
+		}
+		tracker.Finish(nil)
+		log.Printf("File uploaded successfully")
+
+		// Return success response
+		outcome.StatusCode = http.StatusOK
+		outcome.FileName = result.FileName
+		outcome.Response = map[string]interface{}{
+			"status":           "success",
+			"message":          "File uploaded successfully",
+			"downloadURL":      result.DownloadURL,
+			"remote":           result.Remote,
+			"attemptedRemotes": result.AttemptedRemotes,
+			"fileSize":         size,
+			"fileName":         result.FileName,
+			"uploadId":         uploadID,
+			"quickXorHash":     result.QuickXorHash,
+			"verified":         result.Verified,
+			"checksums":        result.Checksums,
+		}
+		if result.SidecarURL != "" {
+			outcome.Response["sidecarURL"] = result.SidecarURL
+		}
+		if result.SidecarError != "" {
+			outcome.Response["sidecarError"] = result.SidecarError
+		}
+		if !result.ExpiresAt.IsZero() {
+			outcome.Response["expiresAt"] = result.ExpiresAt
+		}
+		if result.ExpiryError != "" {
+			outcome.Response["expiryError"] = result.ExpiryError
+		}
+		if result.ShareURL != "" {
+			outcome.Response["shareURL"] = result.ShareURL
+		}
+		if result.ShareError != "" {
+			outcome.Response["shareError"] = result.ShareError
+		}
+		if result.Parts > 0 {
+			outcome.Response["parts"] = result.Parts
+			outcome.Response["manifestURL"] = result.ManifestURL
+			outcome.Response["splitURL"] = result.SplitURL
+		}
+		if job != nil {
+			// Replicas upload in the background; the job reports them as they finish
+			outcome.Response["jobId"] = job.ID
+			outcome.Response["statusURL"] = "/jobs/" + job.ID
+			outcome.Response["replicateTo"] = replicas
+			outcome.Response["downloadURLs"] = map[string]string{result.Remote: result.DownloadURL}
+		}
+	}
+
+	handedOff = true
+	batch.start(upload, consumed)
+	return outcome
+}
+
+// uploadBatch runs the sync uploads of one request in the background, so a file can
+// upload while the request reads the next one, and collects them for the response
+type uploadBatch struct {
+	wg      sync.WaitGroup
+	running atomic.Int32
+}
+
+// busy reports whether an earlier file of the request is still uploading
+func (b *uploadBatch) busy() bool {
+	return b.running.Load() > 0
+}
+
+// start runs upload in the background. If consumed is set, start returns once the
+// upload has read its body from the request or has finished.
+func (b *uploadBatch) start(upload func(), consumed <-chan struct{}) {
+	done := make(chan struct{})
+	b.wg.Add(1)
+	b.running.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.running.Add(-1)
+		defer close(done)
+		upload()
+	}()
+
+	if consumed != nil {
+		select {
+		case <-consumed:
+		case <-done:
+		}
+	}
+}
+
+// wait blocks until every upload of the batch has finished
+func (b *uploadBatch) wait() {
+	b.wg.Wait()
+}
+
+// handoffReader closes done once r has been read to its end or failed. It does not
+// touch r after that, so the request can move on to its next part.
+type handoffReader struct {
+	r      io.Reader
+	done   chan struct{}
+	closed bool
+}
+
+// Read reads from r until the first error, then returns io.EOF
+func (h *handoffReader) Read(p []byte) (int, error) {
+	if h.closed {
+		return 0, io.EOF
+	}
+	n, err := h.r.Read(p)
+	if err != nil {
+		h.closed = true
+		close(h.done)
+	}
+	return n, err
+}
+
+// validateConflictBehavior accepts an empty value or one of the Graph conflict behaviors
+func validateConflictBehavior(conflictBehavior string) error {
+	switch conflictBehavior {
+	case "", azure.ConflictFail, azure.ConflictReplace, azure.ConflictRename:
+		return nil
+	}
+	return fmt.Errorf("invalid conflict behavior: %s (must be fail, replace or rename)", conflictBehavior)
+}
+
+// buildDownloadURL returns the index URL of a file uploaded to remote
+func buildDownloadURL(remote, remoteFolder, filename string) string {
+	return fmt.Sprintf("%s/%s/%s", baseURLs[remote], remoteFolder, filename)
+}
+
+// uploadSpec describes a single file upload
+type uploadSpec struct {
+	Remote       string
+	RemoteFolder string
+	Filename     string
+	Size         int64
+	Params       azure.UploadParams
+	Checksums    *checksumSet  // digests of the received data
+	WriteSidecar bool          // upload <filename>.sha256 next to the file
+	Fallbacks    []string      // remotes left to fail over to
+	Attempted    []string      // remotes given up on before this upload
+	ExpiresIn    time.Duration // delete the file after this long, 0 to keep it
+	SplitSize    int64         // upload the file as parts of this size, 0 to upload it whole
+	ShareLink    *shareOptions // sharing link to create once uploaded, nil for none
+
+	quotaRelease func()        // gives back the space claimed on Remote, nil if none is held
+	ticket       *uploadTicket // the upload's worker, moved along when it fails over
+}
+
+// releaseQuota gives back the space claimed for the upload, once it is known not to go through
+func (s *uploadSpec) releaseQuota() {
+	if s.quotaRelease != nil {
+		s.quotaRelease()
+		s.quotaRelease = nil
+	}
+}
+
+// upload sends body to the spec's remote and verifies it, in parts if the spec is split
+func (s *uploadSpec) upload(ctx context.Context, client *azure.AzureClient, body io.Reader, onVerify func()) (*uploadResult, error) {
+	if s.SplitSize > 0 {
+		return uploadSplit(ctx, client, s, body, onVerify)
+	}
+	return uploadAndVerify(ctx, client, s.Params, body, s.Size, onVerify)
+}
+
+// runUploadJob uploads body in the background and records the outcome in the job store.
+// The result is returned if the upload succeeded.
+func runUploadJob(ctx context.Context, store *JobStore, jobID string, client *azure.AzureClient, spec *uploadSpec, body io.Reader, tracker *ProgressTracker) *uploadResult {
+	log.Printf("Starting upload job %s", jobID)
+	store.Update(jobID, func(job *Job) {
+		job.State = JobUploading
+	})
+
+	spec.Params.Progress = jobProgress(store, jobID, tracker)
+	result, err := completeUpload(ctx, client, spec, body, func() {
+		store.Update(jobID, func(job *Job) {
+			job.State = JobVerifying
+		})
+	})
+	if err != nil {
+		err = cancellationError(ctx, err)
+		failJob(store, jobID, err)
+		tracker.Finish(err)
+		return nil
+	}
+
+	recordJobResult(store, jobID, result)
+	tracker.Finish(nil)
+	log.Printf("Upload job %s completed: %s", jobID, result.DownloadURL)
+	return result
+}
+
+// jobProgress returns an upload progress callback that updates both the tracker and the job
+func jobProgress(store *JobStore, jobID string, tracker *ProgressTracker) func(azure.UploadProgress) {
+	return func(progress azure.UploadProgress) {
+		tracker.UploadProgress(progress)
+		store.UpdateProgress(jobID, func(job *Job) {
+			job.BytesSent = progress.BytesSent
+			job.Retries = progress.Retries
+		})
+	}
+}
+
+// recordJobResult marks a job as done with the outcome of its upload
+func recordJobResult(store *JobStore, jobID string, result *uploadResult) {
+	store.Update(jobID, func(job *Job) {
+		job.State = JobDone
+		job.Remote = result.Remote
+		job.AttemptedRemotes = result.AttemptedRemotes
+		job.FileName = result.FileName
+		job.DownloadURL = result.DownloadURL
+		job.QuickXorHash = result.QuickXorHash
+		job.Verified = result.Verified
+		job.Checksums = result.Checksums
+		job.SidecarURL = result.SidecarURL
+		job.Parts = result.Parts
+		job.ManifestURL = result.ManifestURL
+		job.SplitURL = result.SplitURL
+		job.ShareURL = result.ShareURL
+		if !result.ExpiresAt.IsZero() {
+			expiresAt := result.ExpiresAt
+			job.ExpiresAt = &expiresAt
+		}
+	})
 }
 
-// progressWriter tracks upload progress
-type progressWriter struct {
-	total     int64
-	processed int64
+// completeUpload uploads and verifies a file, failing over to other remotes if needed,
+// then writes its checksum sidecar if requested
+func completeUpload(ctx context.Context, client *azure.AzureClient, spec *uploadSpec, body io.Reader, onVerify func()) (*uploadResult, error) {
+	result, client, err := uploadWithFailover(ctx, client, spec, body, onVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.FileName == "" {
+		result.FileName = spec.Filename
+	}
+	if result.FileName != spec.Filename && spec.SplitSize == 0 {
+		log.Printf("OneDrive stored %s as %s", spec.Filename, result.FileName)
+	}
+	result.DownloadURL = buildDownloadURL(spec.Remote, spec.RemoteFolder, result.FileName)
+	result.Checksums = spec.Checksums.Digests()
+
+	// The manifest of a split file already records its checksums
+	var sidecarID string
+	if spec.WriteSidecar && spec.SplitSize == 0 {
+		result.SidecarURL, sidecarID, err = uploadSidecar(ctx, client, spec, result.FileName, result.Checksums["sha256"])
+		if err != nil {
+			log.Printf("Failed to write checksum sidecar for %s: %v", result.FileName, err)
+			result.SidecarError = err.Error()
+		}
+	}
+	scheduleUploadExpiry(spec, result, sidecarID)
+	shareUpload(ctx, client, spec, result)
+
+	return result, nil
+}
+
+// uploadSidecar uploads <filename>.sha256 next to the file and returns its download URL and item ID.
+// An existing sidecar is replaced since it describes the file that was just uploaded.
+func uploadSidecar(ctx context.Context, client *azure.AzureClient, spec *uploadSpec, filename, digest string) (string, string, error) {
+	name := filename + ".sha256"
+	content := sidecarContent(digest, filename)
+
+	params := spec.Params
+	params.RemoteFilePath = filepath.Join(rootFolders[spec.Remote], spec.RemoteFolder, name)
+	params.ConflictBehavior = azure.ConflictReplace
+	params.Progress = nil
+
+	item, err := client.UploadFromReader(ctx, http.DefaultClient, strings.NewReader(content), int64(len(content)), params)
+	if err != nil {
+		return "", "", err
+	}
+	return buildDownloadURL(spec.Remote, spec.RemoteFolder, name), item.ID, nil
+}
+
+// uploadResult is the outcome of a verified upload
+type uploadResult struct {
+	FileID           string
+	FileName         string // name assigned by OneDrive
+	QuickXorHash     string
+	Verified         bool
+	Remote           string   // remote that took the upload
+	AttemptedRemotes []string // every remote tried, ending with Remote
+	DownloadURL      string
+	Checksums        map[string]string
+	SidecarURL       string
+	SidecarError     string
+	ExpiresAt        time.Time // when the file is deleted, zero if it is kept
+	ExpiryError      string
+	Parts            int    // number of parts of a split file, 0 if stored whole
+	ManifestURL      string // index URL of a split file's manifest
+	SplitURL         string // path GET /split serves a split file from
+	ShareURL         string // OneDrive sharing link, if one was requested
+	ShareError       string
+}
+
+// uploadAndVerify uploads size bytes from body and compares the QuickXorHash computed
+// while reading it against the hash OneDrive reports for the uploaded item.
+// onVerify, if set, is called once all data has been sent.
+func uploadAndVerify(ctx context.Context, client *azure.AzureClient, params azure.UploadParams, body io.Reader, size int64, onVerify func()) (*uploadResult, error) {
+	hasher := azure.NewQuickXorHash()
+	item, err := client.UploadFromReader(ctx, http.DefaultClient, io.TeeReader(body, hasher), size, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if onVerify != nil {
+		onVerify()
+	}
+
+	result := &uploadResult{
+		FileID:       item.ID,
+		FileName:     item.Name,
+		QuickXorHash: azure.EncodeQuickXorHash(hasher.Sum(nil)),
+	}
+	result.Verified, err = verifyUpload(ctx, client, item, result.QuickXorHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// verifyUpload compares a locally computed QuickXorHash with the one OneDrive reports.
+// The hash in the returned item is used when present, saving a metadata request.
+// The remote item is deleted when they differ. If OneDrive does not report a hash
+// the upload is left in place and reported as unverified.
+func verifyUpload(ctx context.Context, client *azure.AzureClient, item *azure.DriveItem, localHash string) (bool, error) {
+	var remoteHash string
+	if item.File != nil {
+		remoteHash = item.File.Hashes.QuickXorHash
+	}
+	if remoteHash == "" {
+		var err error
+		remoteHash, err = client.GetQuickXorHash(ctx, http.DefaultClient, item.ID)
+		if err != nil {
+			log.Printf("Unable to verify file %s: %v", item.ID, err)
+			return false, nil
+		}
+	}
+
+	if remoteHash != localHash {
+		log.Printf("QuickXorHash mismatch for file %s: local %s, remote %s", item.ID, localHash, remoteHash)
+		if err := client.DeleteItem(ctx, http.DefaultClient, item.ID); err != nil {
+			log.Printf("Failed to delete corrupted file %s: %v", item.ID, err)
+		}
+		return false, fmt.Errorf("%w: local %s, remote %s", errHashMismatch, localHash, remoteHash)
+	}
+
+	log.Printf("Verified file %s with quickXorHash %s", item.ID, localHash)
+	return true, nil
+}
+
+// failJob marks a job as failed with the given error
+func failJob(store *JobStore, jobID string, err error) {
+	log.Printf("Upload job %s failed: %v", jobID, err)
+	store.Update(jobID, func(job *Job) {
+		job.State = JobFailed
+		if errors.Is(err, context.Canceled) {
+			job.State = JobCancelled
+		}
+		job.Error = err.Error()
+		job.ErrorCode = errorCode(err)
+		if attempted := attemptedRemotes(err); attempted != nil {
+			job.AttemptedRemotes = attempted
+		}
+	})
+}
+
+// uploadOptionHeaders maps multipart form fields to the headers used in binary upload mode
+var uploadOptionHeaders = map[string]string{
+	"remote":           "X-Remote",
+	"remoteFolder":     "X-Remote-Folder",
+	"chunkSize":        "X-Chunk-Size",
+	"async":            "X-Async",
+	"uploadId":         "X-Upload-ID",
+	"sha256":           "X-Content-SHA256",
+	"sha1":             "X-Content-SHA1",
+	"md5":              "X-Content-MD5",
+	"writeSidecar":     "X-Write-Sidecar",
+	"conflictBehavior": "X-Conflict-Behavior",
+	"priority":         "X-Upload-Priority",
+	"replicateTo":      "X-Replicate-To",
+	"expiresIn":        "X-Expires-In",
+	"splitSize":        "X-Split-Size",
+	"shareLink":        "X-Share-Link",
+}
+
+// uploadOptionHeaderList returns the option headers as a comma separated list for CORS
+func uploadOptionHeaderList() string {
+	headers := make([]string, 0, len(uploadOptionHeaders))
+	for _, header := range uploadOptionHeaders {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ", ")
+}
+
+// maxFormFieldSize limits the size of a single non-file multipart field
+const maxFormFieldSize = 1 << 20
+
+// readMultipartFields reads form fields up to the next "file" part and returns them
+// together with the file part, which is left unread for streaming.
+// At the end of the form the returned part is nil.
+func readMultipartFields(reader *multipart.Reader) (map[string]string, *multipart.Part, error) {
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fields, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FormName() == "file" {
+			return fields, part, nil
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		part.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read form field %s: %v", part.FormName(), err)
+		}
+		fields[part.FormName()] = string(value)
+	}
+}
+
+// cancellationError reports err as a cancellation if ctx was cancelled,
+// since not every layer wraps the context's error
+func cancellationError(ctx context.Context, err error) error {
+	if ctx.Err() == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return fmt.Errorf("upload cancelled: %w", ctx.Err())
+}
+
+// contextReader stops reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read returns the context's error once it is done
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// spoolToTempFile copies r into a temporary file and rewinds it, returning the file and its size
+func spoolToTempFile(r io.Reader, filename string, maxSize int64) (*os.File, int64, error) {
+	tempFile, err := os.CreateTemp("", fmt.Sprintf("upload-%s-*.tmp", filepath.Base(filename)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to create temp file: %v", err)
+	}
+
+	written, err := io.Copy(tempFile, io.LimitReader(r, maxSize+1))
+	if err == nil && written > maxSize {
+		err = fmt.Errorf("file exceeds limit of %d bytes", maxSize)
+	}
+	if err == nil {
+		_, err = tempFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, 0, err
+	}
+	log.Printf("Spooled %d bytes to temporary file %s", written, tempFile.Name())
+
+	return tempFile, written, nil
 }
 
-func (pw *progressWriter) Write(p []byte) (int, error) {
-	n := len(p)
-	pw.processed += int64(n)
-	progress := float64(pw.processed) / float64(pw.total) * 100
-	log.Printf("Upload progress: %.2f%% (%d/%d bytes)", progress, pw.processed, pw.total)
-	return n, nil
+// removeTempFile closes and deletes a temporary file
+func removeTempFile(tempFile *os.File) {
+	tempFile.Close()
+	os.Remove(tempFile.Name())
+	log.Printf("Cleaned up temporary file: %s", tempFile.Name())
 }
@@ -0,0 +1,502 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	"github.com/ksauraj/ksau-oned-api/config"
+)
+
+const (
+	// maxSourceRedirects is the number of redirects followed when fetching a source URL
+	maxSourceRedirects = 5
+	// sourceResponseTimeout is how long the source server may take to send response headers
+	sourceResponseTimeout = 30 * time.Second
+	// maxURLUploadRequestSize limits the JSON body of POST /upload/url
+	maxURLUploadRequestSize = 64 << 10
+)
+
+// errSourceNotAllowed is returned when a source URL is rejected by the allowlist or address checks
+var errSourceNotAllowed = errors.New("source not allowed")
+
+// internalNetworks are refused along with loopback, private and link-local addresses:
+// carrier-grade NAT space and the NAT64 prefix, which reaches IPv4 hosts through a gateway
+var internalNetworks = []*net.IPNet{
+	{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)},
+	{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)},
+}
+
+// urlUploadRequest is the body of POST /upload/url
+type urlUploadRequest struct {
+	URL              string   `json:"url"`
+	Remote           string   `json:"remote"`
+	RemoteFolder     string   `json:"remoteFolder"`
+	Filename         string   `json:"filename"`
+	ChunkSize        int64    `json:"chunkSize"` // in MB (2-32), 0 for the default
+	ConflictBehavior string   `json:"conflictBehavior"`
+	UploadID         string   `json:"uploadId"`
+	SHA256           string   `json:"sha256"`
+	SHA1             string   `json:"sha1"`
+	MD5              string   `json:"md5"`
+	WriteSidecar     bool     `json:"writeSidecar"`
+	Priority         string   `json:"priority"`
+	ReplicateTo      []string `json:"replicateTo"`
+	ExpiresIn        string   `json:"expiresIn"`
+	SplitSize        string   `json:"splitSize"`
+	ShareLink        string   `json:"shareLink"`
+}
+
+// fields returns the request as upload form fields
+func (req *urlUploadRequest) fields() map[string]string {
+	return map[string]string{
+		"remote":           req.Remote,
+		"remoteFolder":     req.RemoteFolder,
+		"chunkSize":        jsonChunkSize(req.ChunkSize),
+		"conflictBehavior": req.ConflictBehavior,
+		"writeSidecar":     strconv.FormatBool(req.WriteSidecar),
+		"sha256":           req.SHA256,
+		"sha1":             req.SHA1,
+		"md5":              req.MD5,
+		"priority":         req.Priority,
+		"replicateTo":      strings.Join(req.ReplicateTo, ","),
+		"expiresIn":        req.ExpiresIn,
+		"splitSize":        req.SplitSize,
+		"shareLink":        req.ShareLink,
+	}
+}
+
+// sourcePolicy decides which URLs may be fetched
+type sourcePolicy struct {
+	hosts        []string // exact host names, or suffixes starting with "*."
+	allowPrivate bool     // allow loopback, private and link-local addresses
+}
+
+// getSourcePolicy reads the policy from UPLOAD_URL_ALLOWLIST and UPLOAD_URL_ALLOW_PRIVATE.
+// Without an allowlist no source is allowed.
+func getSourcePolicy() *sourcePolicy {
+	policy := &sourcePolicy{}
+	for _, host := range strings.Split(config.GetEnvWithDefault("UPLOAD_URL_ALLOWLIST", ""), ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			policy.hosts = append(policy.hosts, host)
+		}
+	}
+	policy.allowPrivate, _ = strconv.ParseBool(config.GetEnvWithDefault("UPLOAD_URL_ALLOW_PRIVATE", "false"))
+	return policy
+}
+
+// checkURL validates the scheme and host of a source URL against the allowlist
+func (p *sourcePolicy) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q", errSourceNotAllowed, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in URL are not supported", errSourceNotAllowed)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: missing host", errSourceNotAllowed)
+	}
+	for _, allowed := range p.hosts {
+		if allowed == "*" || allowed == host {
+			return nil
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %s is not in the allowlist", errSourceNotAllowed, host)
+}
+
+// checkAddress rejects connections to internal addresses. It runs after DNS resolution,
+// so host names that resolve to internal addresses are caught as well.
+func (p *sourcePolicy) checkAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: invalid address %s", errSourceNotAllowed, address)
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%w: address %s", errSourceNotAllowed, ip)
+	}
+	if p.allowPrivate {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("%w: internal address %s", errSourceNotAllowed, ip)
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: internal address %s", errSourceNotAllowed, ip)
+		}
+	}
+	return nil
+}
+
+// newSourceClient returns an HTTP client that only connects to sources allowed by the policy
+func newSourceClient(policy *sourcePolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return policy.checkAddress(address)
+		},
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: sourceResponseTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxSourceRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxSourceRedirects)
+			}
+			return policy.checkURL(req.URL)
+		},
+	}
+}
+
+// sourceFilename picks the file name for a fetched source: the Content-Disposition
+// filename if present, otherwise the last segment of the final URL path
+func sourceFilename(resp *http.Response) string {
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			if name := cleanFilename(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+	return cleanFilename(path.Base(resp.Request.URL.Path))
+}
+
+// cleanFilename strips directories from a file name and rejects names that cannot be uploaded
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// URLUploadHandler handles POST /upload/url, which fetches a file from another
+// server and uploads it to OneDrive as an asynchronous job
+func URLUploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, X-Upload-ID")
+
+	// Handle preflight requests
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Only allow POST requests
+	if r.Method != "POST" {
+		sendErrorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method), "Method not allowed")
+		return
+	}
+
+	var req urlUploadRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxURLUploadRequestSize)).Decode(&req); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err), "Invalid request")
+		return
+	}
+
+	// Validate parameters
+	if req.URL == "" {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("url is required"), "Invalid request")
+		return
+	}
+	sourceURL, err := url.Parse(req.URL)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid url: %v", err), "Invalid request")
+		return
+	}
+
+	policy := getSourcePolicy()
+	if err := policy.checkURL(sourceURL); err != nil {
+		sendErrorResponse(w, http.StatusForbidden, err, "Source URL not allowed")
+		return
+	}
+
+	fields := req.fields()
+	opts, err := parseUploadOptions(fields)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+	opts.Client = uploadClientKey(r)
+
+	expectedChecksums, err := parseExpectedChecksums(fields)
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, err, "Invalid request")
+		return
+	}
+
+	filename := req.Filename
+	if filename != "" {
+		if filename = cleanFilename(filename); filename == "" {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid filename: %s", req.Filename), "Invalid request")
+			return
+		}
+	}
+
+	// The source's size is not known yet; it is checked against the quota once fetched
+	if err := resolveRemote(r.Context(), opts, -1); err != nil {
+		if errors.Is(err, errInsufficientStorage) {
+			sendErrorResponse(w, http.StatusInsufficientStorage, err, "Insufficient storage")
+			return
+		}
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "No remote available")
+		return
+	}
+
+	client, err := connectRemote(r.Context(), opts, -1)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Failed to initialize Azure client")
+		return
+	}
+
+	store, err := getJobStore()
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Job store unavailable")
+		return
+	}
+
+	uploadID, err := newUploadID(req.UploadID)
+	if err != nil {
+		status, message := idError(err, http.StatusBadRequest, "Invalid request")
+		sendErrorResponse(w, status, err, message)
+		return
+	}
+	tracker, err := acquireProgressTracker(uploadID, -1)
+	if err != nil {
+		status, message := idError(err, http.StatusConflict, "Upload ID in use")
+		sendErrorResponse(w, status, err, message)
+		return
+	}
+	w.Header().Set("X-Upload-ID", uploadID)
+
+	// Queue the upload for a worker, turning it away if the remote's queue is full
+	ticket, err := getUploadScheduler().schedule(uploadID, opts.Client, opts.Remote, opts.Priority)
+	if err != nil {
+		tracker.Finish(err)
+		w.Header().Set("Retry-After", retryAfterHeader(queueRetryAfter))
+		sendErrorResponse(w, http.StatusServiceUnavailable, err, "Too many uploads, try again later")
+		return
+	}
+
+	job := &Job{
+		ID:           uploadID,
+		State:        JobReceiving,
+		Remote:       opts.Remote,
+		RemoteFolder: opts.RemoteFolder,
+		FileName:     filename,
+		FileSize:     -1,
+		SourceURL:    sourceURL.String(),
+		Priority:     opts.Priority.String(),
+	}
+	if err := store.Create(job); err != nil {
+		ticket.release()
+		tracker.Finish(err)
+		sendErrorResponse(w, http.StatusInternalServerError, err, "Unable to create job")
+		return
+	}
+	log.Printf("Created URL upload job %s for %s", job.ID, sourceURL.Redacted())
+
+	// The job outlives the request, so it can only be cancelled explicitly
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker.SetCancel(cancel)
+	go func() {
+		defer cancel()
+		defer ticket.release()
+		if err := waitForJobTurn(ctx, store, job.ID, ticket, tracker, PhaseReceiving, JobReceiving); err != nil {
+			return
+		}
+		runURLUploadJob(ctx, store, job.ID, client, ticket, opts, sourceURL, filename, expectedChecksums, newSourceClient(policy), tracker)
+	}()
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	response := map[string]interface{}{
+		"status":      "accepted",
+		"message":     "Upload from URL queued",
+		"jobId":       job.ID,
+		"uploadId":    uploadID,
+		"cancelToken": tracker.CancelToken(),
+		"statusURL":   "/jobs/" + job.ID,
+		"eventsURL":   "/uploads/" + uploadID + "/events",
+		"sourceURL":   job.SourceURL,
+		"remote":      job.Remote,
+		"priority":    job.Priority,
+	}
+	if len(opts.ReplicateTo) > 0 {
+		response["replicateTo"] = opts.ReplicateTo
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// runURLUploadJob fetches the source and uploads it. Sources with a known length are
+// streamed straight into the upload session; others, sources with an expected
+// checksum and uploads that may fail over or are replicated to other remotes are spooled
+// to disk first.
+func runURLUploadJob(ctx context.Context, store *JobStore, jobID string, client *azure.AzureClient, ticket *uploadTicket, opts *uploadOptions, sourceURL *url.URL, filename string, expectedChecksums map[string]string, sourceClient *http.Client, tracker *ProgressTracker) {
+	var tempFile *os.File
+	releaseQuota := noRelease
+	fail := func(err error) {
+		err = cancellationError(ctx, err)
+		releaseQuota()
+		if tempFile != nil {
+			removeTempFile(tempFile)
+		}
+		failJob(store, jobID, err)
+		tracker.Finish(err)
+	}
+
+	log.Printf("Fetching %s for job %s", sourceURL.Redacted(), jobID)
+	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL.String(), nil)
+	if err != nil {
+		fail(fmt.Errorf("failed to fetch source: %w", err))
+		return
+	}
+	resp, err := sourceClient.Do(req)
+	if err != nil {
+		fail(fmt.Errorf("failed to fetch source: %w", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fail(fmt.Errorf("failed to fetch source: %s", resp.Status))
+		return
+	}
+
+	if filename == "" {
+		filename = sourceFilename(resp)
+	}
+	if filename == "" {
+		fail(fmt.Errorf("unable to determine a filename for %s", sourceURL.Redacted()))
+		return
+	}
+
+	size := resp.ContentLength
+	if size > opts.maxFileSize() {
+		fail(fmt.Errorf("file size %d exceeds limit of %d bytes", size, opts.maxFileSize()))
+		return
+	}
+	release, err := claimQuota(ctx, opts.Remote, size)
+	if err != nil {
+		fail(err)
+		return
+	}
+	releaseQuota = release
+	tracker.SetTotal(size)
+	store.Update(jobID, func(job *Job) {
+		job.FileName = filename
+		job.FileSize = size
+	})
+
+	remoteFilePath := filepath.Join(rootFolders[opts.Remote], opts.RemoteFolder, filename)
+	log.Printf("Remote file path: %s", remoteFilePath)
+
+	spec := &uploadSpec{
+		Remote:       opts.Remote,
+		RemoteFolder: opts.RemoteFolder,
+		Filename:     filename,
+		Size:         size,
+		Checksums:    newChecksumSet(),
+		WriteSidecar: opts.WriteSidecar,
+		Fallbacks:    opts.Fallbacks,
+		Attempted:    opts.Attempted,
+		ExpiresIn:    opts.ExpiresIn,
+		SplitSize:    opts.SplitSize,
+		ShareLink:    opts.ShareLink,
+		Params: azure.UploadParams{
+			RemoteFilePath: remoteFilePath,
+			ChunkSize:      opts.ChunkSize,
+			MaxRetries:     5,
+			RetryDelay:     10 * time.Second,
+			AccessToken:    client.AccessToken,
+
+			ConflictBehavior: opts.ConflictBehavior,
+		},
+		quotaRelease: release,
+		ticket:       ticket,
+	}
+	releaseQuota = spec.releaseQuota
+
+	limited := azure.NewRateLimitedReader(ctx, resp.Body, getRemoteLimits(opts.Remote).receiveLimiters()...)
+	received := io.TeeReader(limited, io.MultiWriter(tracker, spec.Checksums))
+
+	// Uploads to a remote with a failover chain or replicas are spooled so they can be sent again
+	var body io.Reader = received
+	if size < 0 || len(expectedChecksums) > 0 || len(opts.Fallbacks) > 0 || len(opts.ReplicateTo) > 0 {
+		spooled, spooledSize, err := spoolToTempFile(received, filename, opts.maxFileSize())
+		if err != nil {
+			fail(fmt.Errorf("failed to fetch source: %w", err))
+			return
+		}
+		tempFile = spooled
+		if size >= 0 && spooledSize != size {
+			fail(fmt.Errorf("received %d bytes, expected %d", spooledSize, size))
+			return
+		}
+		if err := verifyChecksums(expectedChecksums, spec.Checksums.Digests()); err != nil {
+			fail(err)
+			return
+		}
+		if size < 0 {
+			if spec.quotaRelease, err = claimQuota(ctx, opts.Remote, spooledSize); err != nil {
+				fail(err)
+				return
+			}
+		}
+		body = tempFile
+		size = spooledSize
+		spec.Size = size
+		tracker.SetTotal(size)
+		store.Update(jobID, func(job *Job) {
+			job.FileSize = size
+		})
+	}
+
+	if size == 0 {
+		fail(fmt.Errorf("file is empty"))
+		return
+	}
+
+	tracker.SetPhase(PhaseUploading)
+	result := runUploadJob(ctx, store, jobID, client, spec, body, tracker)
+	if result != nil && len(opts.ReplicateTo) > 0 {
+		startReplication(store, jobID, opts, spec, result, tempFile)
+		return
+	}
+	if tempFile != nil {
+		removeTempFile(tempFile)
+	}
+}
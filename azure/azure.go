@@ -2,10 +2,12 @@ package azure
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,6 +16,16 @@ import (
 	"time"
 )
 
+// Conflict behaviors for uploads whose target path already exists
+const (
+	ConflictFail    = "fail"
+	ConflictReplace = "replace"
+	ConflictRename  = "rename"
+)
+
+// ErrConflict is returned when an upload with ConflictFail targets an existing item
+var ErrConflict = errors.New("item already exists")
+
 // AzureClient represents the Azure connection with credentials
 type AzureClient struct {
 	ClientID     string
@@ -23,7 +35,12 @@ type AzureClient struct {
 	Expiration   time.Time
 	DriveID      string
 	DriveType    string
-	mu           sync.Mutex
+	RetryPolicy  RetryPolicy // zero fields fall back to DefaultRetryPolicy
+
+	// UploadLimiters throttle the file data sent to OneDrive
+	UploadLimiters []*RateLimiter
+
+	mu sync.Mutex
 }
 
 // NewAzureClientFromRcloneConfigData initializes the AzureClient from embedded rclone config data
@@ -102,7 +119,7 @@ func ParseRcloneConfigData(configData []byte, remoteConfig string) (map[string]s
 }
 
 // EnsureTokenValid checks and refreshes the access token if expired
-func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
+func (client *AzureClient) EnsureTokenValid(ctx context.Context, httpClient *http.Client) error {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
@@ -117,13 +134,14 @@ func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
 	data.Set("refresh_token", client.RefreshToken)
 	data.Set("grant_type", "refresh_token")
 
-	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err := httpClient.Do(req)
+	res, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
@@ -150,21 +168,11 @@ func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
 	return nil
 }
 
-// Upload uploads a file to OneDrive using parallel chunk uploads
-func (client *AzureClient) Upload(httpClient *http.Client, params UploadParams) (string, error) {
-	fmt.Println("Starting file upload with upload session...")
-
-	// Ensure the access token is valid
-	if err := client.EnsureTokenValid(httpClient); err != nil {
-		return "", err
-	}
-
-	// Create an upload session
-	uploadURL, err := client.createUploadSession(httpClient, params.RemoteFilePath, client.AccessToken)
-	if err != nil {
-		return "", fmt.Errorf("failed to create upload session: %v", err)
-	}
-	fmt.Println("Upload session created successfully.")
+// Upload uploads the local file at params.FilePath and returns its item ID.
+// OneDrive rejects concurrent ranges within an upload session, so the chunks are
+// sent in order; run several uploads at once to upload files in parallel.
+func (client *AzureClient) Upload(ctx context.Context, httpClient *http.Client, params UploadParams) (string, error) {
+	fmt.Println("Starting file upload...")
 
 	// Open the file to upload
 	file, err := os.Open(params.FilePath)
@@ -178,87 +186,135 @@ func (client *AzureClient) Upload(httpClient *http.Client, params UploadParams)
 	if err != nil {
 		return "", fmt.Errorf("failed to get file info: %v", err)
 	}
-	fileSize := fileInfo.Size()
-	fmt.Printf("File size: %d bytes\n", fileSize)
+	fmt.Printf("File size: %d bytes\n", fileInfo.Size())
+
+	item, err := client.UploadFromReader(ctx, httpClient, file, fileInfo.Size(), params)
+	if err != nil {
+		return "", err
+	}
+	return item.ID, nil
+}
+
+// UploadFromReader uploads size bytes read from r to OneDrive using an upload session.
+// Only one chunk is held in memory at a time; each chunk is sent as soon as it is buffered.
+// The returned DriveItem carries the name OneDrive assigned, which differs from the requested
+// one when the file was renamed because of a conflict.
+func (client *AzureClient) UploadFromReader(ctx context.Context, httpClient *http.Client, r io.Reader, size int64, params UploadParams) (*DriveItem, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size: %d", size)
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return nil, err
+	}
+
+	// Small files are uploaded in a single request
+	if size < SimpleUploadMaxSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("upload body ended early: expected %d bytes", size)
+		}
+		var extra [1]byte
+		if n, _ := r.Read(extra[:]); n > 0 {
+			return nil, fmt.Errorf("upload body exceeds declared size of %d bytes", size)
+		}
+		return client.uploadSmallWithRetry(ctx, httpClient, data, params)
+	}
+
+	// Create an upload session
+	uploadURL, err := client.createUploadSession(ctx, httpClient, params.RemoteFilePath, client.AccessToken, params.ConflictBehavior)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload session: %w", err)
+	}
+
+	item, err := client.streamToSession(ctx, httpClient, uploadURL, r, size, params)
+	if err != nil {
+		// Make OneDrive discard the partial upload
+		client.discardUploadSession(ctx, httpClient, uploadURL)
+		return nil, err
+	}
+
+	if item == nil || item.ID == "" {
+		// Fall back to looking the file up if the final response carried no item
+		fileID, err := client.getFileID(ctx, httpClient, params.RemoteFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch file ID: %v", err)
+		}
+		return client.GetItem(ctx, httpClient, fileID)
+	}
 
-	// Define chunk size and calculate the number of chunks
+	return item, nil
+}
+
+// streamToSession reads size bytes from r and uploads them to an upload session, one chunk at a time.
+// It returns the DriveItem from the final chunk's response, which may be nil.
+func (client *AzureClient) streamToSession(ctx context.Context, httpClient *http.Client, uploadURL string, r io.Reader, size int64, params UploadParams) (*DriveItem, error) {
 	chunkSize := params.ChunkSize
-	numChunks := (fileSize + chunkSize - 1) / chunkSize
-
-	// Create a worker pool for parallel uploads
-	var wg sync.WaitGroup
-	chunkChan := make(chan int64, numChunks)
-	errChan := make(chan error, numChunks)
-
-	// Start workers
-	for i := 0; i < params.ParallelChunks; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for start := range chunkChan {
-				end := start + chunkSize - 1
-				if end >= fileSize {
-					end = fileSize - 1
-				}
-
-				// Read the current chunk from the file
-				chunk := make([]byte, end-start+1)
-				_, err := file.ReadAt(chunk, start)
-				if err != nil && err != io.EOF {
-					errChan <- fmt.Errorf("failed to read chunk %d-%d: %v", start, end, err)
-					continue
-				}
-
-				// Retry logic for chunk upload
-				for retry := 0; retry < params.MaxRetries; retry++ {
-					success, err := client.uploadChunk(httpClient, uploadURL, chunk, start, end, fileSize)
-					if success {
-						break
-					}
-
-					fmt.Printf("Error uploading chunk %d-%d: %v\n", start, end, err)
-					fmt.Printf("Retrying chunk upload (attempt %d/%d)...\n", retry+1, params.MaxRetries)
-					time.Sleep(params.RetryDelay)
-				}
-			}
-		}()
+	if chunkSize > size {
+		chunkSize = size
 	}
+	buf := make([]byte, chunkSize)
+	var item *DriveItem
+	policy := params.retryPolicy(client)
 
-	// Send chunk start positions to the workers
-	for start := int64(0); start < fileSize; start += chunkSize {
-		chunkChan <- start
+	progress := UploadProgress{
+		TotalBytes: size,
+		Chunks:     int((size + chunkSize - 1) / chunkSize),
 	}
-	close(chunkChan)
 
-	// Wait for all workers to finish
-	wg.Wait()
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		chunk := buf[:end-start+1]
+		progress.Chunk++
+
+		// Fill the buffer with the next chunk of the stream
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("upload body ended early: expected %d bytes", size)
+			}
+			return nil, fmt.Errorf("failed to read chunk %d-%d: %v", start, end, err)
+		}
+
+		// Refuse to commit the final chunk if the stream carries more data than declared
+		if end == size-1 {
+			var extra [1]byte
+			if n, _ := r.Read(extra[:]); n > 0 {
+				return nil, fmt.Errorf("upload body exceeds declared size of %d bytes", size)
+			}
+		}
 
-	// Check for errors
-	select {
-	case err := <-errChan:
-		return "", fmt.Errorf("failed to upload file: %v", err)
-	default:
-		fileID, err := client.getFileID(httpClient, params.RemoteFilePath)
+		// Upload the chunk, resuming from what OneDrive has after a failure
+		var err error
+		item, err = client.sendChunk(ctx, httpClient, uploadURL, chunk, start, end, size, policy, true, func() {
+			progress.Retries++
+			params.reportProgress(progress)
+		})
 		if err != nil {
-			return "", fmt.Errorf("failed to fetch file ID: %v", err)
+			return nil, fmt.Errorf("failed to upload chunk %d-%d: %w", start, end, err)
 		}
 
-		return fileID, nil
+		progress.BytesSent = end + 1
+		params.reportProgress(progress)
 	}
 
+	return item, nil
 }
 
 // getFileID retrieves the file ID for a given remote path
-func (client *AzureClient) getFileID(httpClient *http.Client, remotePath string) (string, error) {
+func (client *AzureClient) getFileID(ctx context.Context, httpClient *http.Client, remotePath string) (string, error) {
 	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s", remotePath)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
-
-	resp, err := httpClient.Do(req)
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		return req, nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch file metadata: %v", err)
 	}
@@ -285,32 +341,39 @@ func (client *AzureClient) getFileID(httpClient *http.Client, remotePath string)
 }
 
 // createUploadSession creates an upload session for the file
-func (client *AzureClient) createUploadSession(httpClient *http.Client, remotePath string, accessToken string) (string, error) {
+func (client *AzureClient) createUploadSession(ctx context.Context, httpClient *http.Client, remotePath string, accessToken string, conflictBehavior string) (string, error) {
 	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s:/createUploadSession", remotePath)
+	if conflictBehavior == "" {
+		conflictBehavior = ConflictRename
+	}
 	requestBody := map[string]interface{}{
 		"item": map[string]string{
-			"@microsoft.graph.conflictBehavior": "rename",
+			"@microsoft.graph.conflictBehavior": conflictBehavior,
 		},
 	}
 	body, _ := json.Marshal(requestBody)
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return "", fmt.Errorf("failed to create upload session request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create upload session request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to create upload session: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusConflict {
 		responseBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to create upload session, status: %d, response: %s", resp.StatusCode, responseBody)
+		return "", fmt.Errorf("%w: %s", ErrConflict, responseBody)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError("failed to create upload session", resp)
 	}
 
 	var response struct {
@@ -323,74 +386,308 @@ func (client *AzureClient) createUploadSession(httpClient *http.Client, remotePa
 	return response.UploadUrl, nil
 }
 
-// uploadChunk uploads a single chunk of the file
-func (client *AzureClient) uploadChunk(httpClient *http.Client, uploadURL string, chunk []byte, start, end, totalSize int64) (bool, error) {
-	req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(chunk))
+// uploadChunk makes a single attempt at uploading a chunk of the file; see sendChunk for retries.
+// When the chunk completes the file, the created DriveItem is returned.
+func (client *AzureClient) uploadChunk(ctx context.Context, httpClient *http.Client, uploadURL string, chunk []byte, start, end, totalSize int64) (*DriveItem, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL, client.uploadBody(ctx, chunk))
 	if err != nil {
-		return false, fmt.Errorf("failed to create chunk upload request: %v", err)
+		return nil, fmt.Errorf("failed to create chunk upload request: %v", err)
 	}
+	req.ContentLength = int64(len(chunk))
 
 	rangeHeader := fmt.Sprintf("bytes %d-%d/%d", start, end, totalSize)
 	req.Header.Set("Content-Range", rangeHeader)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("failed to upload chunk: %v", err)
+		return nil, fmt.Errorf("failed to upload chunk: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusAccepted {
-		return true, nil
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return nil, nil
+	case http.StatusOK, http.StatusCreated:
+		// The final chunk returns the completed item
+		var item DriveItem
+		if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+			return nil, fmt.Errorf("failed to parse uploaded item: %v", err)
+		}
+		return &item, nil
+	case http.StatusConflict:
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %s", ErrConflict, responseBody)
 	}
 
-	responseBody, _ := io.ReadAll(resp.Body)
-	return false, fmt.Errorf("failed to upload chunk, status: %d, response: %s", resp.StatusCode, responseBody)
+	return nil, newStatusError("failed to upload chunk", resp)
+}
+
+// uploadBody returns a request body for data, throttled by the client's upload limiters
+func (client *AzureClient) uploadBody(ctx context.Context, data []byte) io.Reader {
+	return NewRateLimitedReader(ctx, bytes.NewReader(data), client.UploadLimiters...)
 }
 
-// itemByPath retrieves the metadata of a folder by its path
-func itemByPath(httpClient *http.Client, accessToken, path string) (*DriveItem, error) {
-	fmt.Println("Retrieving item by path:", path)
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s", path)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+// SimpleUploadMaxSize is the size from which files are uploaded through an upload session instead of a single PUT
+const SimpleUploadMaxSize = 4 * 1024 * 1024
 
-	res, err := httpClient.Do(req)
+// uploadSmallWithRetry uploads data with a single PUT, retrying like chunk uploads
+func (client *AzureClient) uploadSmallWithRetry(ctx context.Context, httpClient *http.Client, data []byte, params UploadParams) (*DriveItem, error) {
+	progress := UploadProgress{
+		TotalBytes: int64(len(data)),
+		Chunk:      1,
+		Chunks:     1,
+	}
+
+	var item *DriveItem
+	err := params.retryPolicy(client).retry(ctx, func() error {
+		var err error
+		item, err = client.uploadSmall(ctx, httpClient, params.RemoteFilePath, data, params.ConflictBehavior)
+		return err
+	}, func() {
+		progress.Retries++
+		params.reportProgress(progress)
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to upload file: %w", err)
 	}
-	defer res.Body.Close()
 
-	fmt.Println("Item by path response status code:", res.StatusCode)
+	progress.BytesSent = progress.TotalBytes
+	params.reportProgress(progress)
+	return item, nil
+}
 
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		responseBody, _ := ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf("failed to retrieve item, status code: %v, response: %s", res.StatusCode, string(responseBody))
+// uploadSmall uploads a file smaller than SimpleUploadMaxSize with a single PUT.
+// The response carries the created DriveItem, including its size and hashes.
+func (client *AzureClient) uploadSmall(ctx context.Context, httpClient *http.Client, remotePath string, data []byte, conflictBehavior string) (*DriveItem, error) {
+	if conflictBehavior == "" {
+		conflictBehavior = ConflictRename
 	}
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s:/content?@microsoft.graph.conflictBehavior=%s", remotePath, conflictBehavior)
 
-	var item DriveItem
-	err = json.NewDecoder(res.Body).Decode(&item)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, client.uploadBody(ctx, data))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to create upload request: %v", err)
 	}
+	req.ContentLength = int64(len(data))
 
-	return &item, nil
+	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var item DriveItem
+		if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+			return nil, fmt.Errorf("failed to parse uploaded item: %v", err)
+		}
+		return &item, nil
+	case http.StatusConflict:
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %s", ErrConflict, responseBody)
+	}
+
+	return nil, newStatusError("failed to upload file", resp)
+}
+
+// CreateUploadSession creates an upload session for remotePath and returns its upload URL
+func (client *AzureClient) CreateUploadSession(ctx context.Context, httpClient *http.Client, remotePath string, conflictBehavior string) (string, error) {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return "", err
+	}
+	return client.createUploadSession(ctx, httpClient, remotePath, client.AccessToken, conflictBehavior)
+}
+
+// UploadChunk uploads the byte range start-end of a file of totalSize bytes to an upload session,
+// retrying and resuming according to the client's retry policy.
+// The completed DriveItem is returned once the last chunk has been uploaded.
+func (client *AzureClient) UploadChunk(ctx context.Context, httpClient *http.Client, uploadURL string, chunk []byte, start, end, totalSize int64) (*DriveItem, error) {
+	return client.sendChunk(ctx, httpClient, uploadURL, chunk, start, end, totalSize, client.retryPolicy(), true, nil)
+}
+
+// CancelUploadSession deletes an upload session so OneDrive discards any data uploaded to it
+func (client *AzureClient) CancelUploadSession(ctx context.Context, httpClient *http.Client, uploadURL string) error {
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "DELETE", uploadURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cancel request: %v", err)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cancel upload session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		responseBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to cancel upload session, status: %d, response: %s", resp.StatusCode, responseBody)
+	}
+
+	return nil
+}
+
+// discardUploadSession deletes the upload session of a failed or cancelled upload.
+// It runs even if ctx is already cancelled.
+func (client *AzureClient) discardUploadSession(ctx context.Context, httpClient *http.Client, uploadURL string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	if err := client.CancelUploadSession(ctx, httpClient, uploadURL); err != nil {
+		log.Printf("Failed to discard upload session: %v", err)
+	}
+}
+
+// GetFileID retrieves the file ID for a given remote path
+func (client *AzureClient) GetFileID(ctx context.Context, httpClient *http.Client, remotePath string) (string, error) {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return "", err
+	}
+	return client.getFileID(ctx, httpClient, remotePath)
 }
 
 // DriveItem represents a file or folder item in the drive
 type DriveItem struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID                   string       `json:"id"`
+	Name                 string       `json:"name"`
+	Size                 int64        `json:"size"`
+	ETag                 string       `json:"eTag,omitempty"`
+	CreatedDateTime      time.Time    `json:"createdDateTime"`
+	LastModifiedDateTime time.Time    `json:"lastModifiedDateTime"`
+	WebURL               string       `json:"webUrl,omitempty"`
+	File                 *FileFacet   `json:"file,omitempty"`
+	Folder               *FolderFacet `json:"folder,omitempty"`
+
+	// ParentReference identifies the folder containing the item
+	ParentReference *ItemReference `json:"parentReference,omitempty"`
+
+	// DownloadURL is a short-lived, pre-authenticated URL of a file's content
+	DownloadURL string `json:"@microsoft.graph.downloadUrl,omitempty"`
+
+	// Children holds the first page of a folder's children when requested with GetItemWithChildren.
+	// ChildrenNextLink is set if there are more.
+	Children         []DriveItem `json:"children,omitempty"`
+	ChildrenNextLink string      `json:"children@odata.nextLink,omitempty"`
+}
+
+// ItemReference points to another item in a drive
+type ItemReference struct {
+	DriveID string `json:"driveId,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+// FolderFacet holds the folder specific properties of a DriveItem
+type FolderFacet struct {
+	ChildCount int `json:"childCount"`
+}
+
+// FileFacet holds the file specific properties of a DriveItem
+type FileFacet struct {
+	MimeType string `json:"mimeType,omitempty"`
+	Hashes   struct {
+		QuickXorHash string `json:"quickXorHash,omitempty"`
+		SHA1Hash     string `json:"sha1Hash,omitempty"`
+		SHA256Hash   string `json:"sha256Hash,omitempty"`
+	} `json:"hashes"`
 }
 
-// UploadParams represents the parameters for the upload operation
+// DeleteItem moves an item to the recycle bin
+func (client *AzureClient) DeleteItem(ctx context.Context, httpClient *http.Client, itemID string) error {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s", itemID)
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create delete request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete item: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return newStatusError("failed to delete item", resp)
+	}
+
+	return nil
+}
+
+// GetItem retrieves the metadata of an item by its ID
+func (client *AzureClient) GetItem(ctx context.Context, httpClient *http.Client, itemID string) (*DriveItem, error) {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s", itemID)
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch item metadata: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to fetch item metadata, status: %d, response: %s", resp.StatusCode, responseBody)
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %v", err)
+	}
+
+	return &item, nil
+}
+
+// UploadParams represents the parameters for the upload operation.
+// FilePath is only used by Upload; UploadFromReader takes its data from the reader.
 type UploadParams struct {
 	FilePath       string
 	RemoteFilePath string
 	ChunkSize      int64
-	ParallelChunks int
-	MaxRetries     int
+	MaxRetries     int // retries after the first attempt
 	RetryDelay     time.Duration
 	AccessToken    string
+
+	// ConflictBehavior is one of ConflictFail, ConflictReplace or ConflictRename (the default)
+	ConflictBehavior string
+
+	// Progress, if set, is called after every chunk attempt
+	Progress func(UploadProgress)
+}
+
+// UploadProgress describes how far an upload session has progressed
+type UploadProgress struct {
+	BytesSent  int64
+	TotalBytes int64
+	Chunk      int
+	Chunks     int
+	Retries    int
+}
+
+// reportProgress invokes the Progress callback if one is set
+func (params UploadParams) reportProgress(progress UploadProgress) {
+	if params.Progress != nil {
+		params.Progress(progress)
+	}
 }
 
 // DriveQuota represents the quota information for a drive
@@ -402,23 +699,23 @@ type DriveQuota struct {
 }
 
 // GetDriveQuota fetches the quota information for the drive
-func (client *AzureClient) GetDriveQuota(httpClient *http.Client) (*DriveQuota, error) {
+func (client *AzureClient) GetDriveQuota(ctx context.Context, httpClient *http.Client) (*DriveQuota, error) {
 	// Ensure the access token is valid
-	if err := client.EnsureTokenValid(httpClient); err != nil {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
 		return nil, err
 	}
 
 	// Construct the URL to get the drive's quota information
 	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/quota")
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create quota request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
-
-	resp, err := httpClient.Do(req)
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create quota request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch quota information: %v", err)
 	}
@@ -473,23 +770,23 @@ func DisplayQuotaInfo(remote string, quota *DriveQuota) {
 }
 
 // GetQuickXorHash retrieves the quickXorHash for a file from OneDrive
-func (client *AzureClient) GetQuickXorHash(httpClient *http.Client, fileID string) (string, error) {
+func (client *AzureClient) GetQuickXorHash(ctx context.Context, httpClient *http.Client, fileID string) (string, error) {
 	// Ensure the access token is valid
-	if err := client.EnsureTokenValid(httpClient); err != nil {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
 		return "", err
 	}
 
 	// Construct the URL to get the file's metadata
 	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s", fileID)
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
-
-	resp, err := httpClient.Do(req)
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		return req, nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch file metadata: %v", err)
 	}
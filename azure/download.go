@@ -0,0 +1,82 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// GetItemByPath retrieves the metadata of the item at remotePath.
+// For files it includes a DownloadURL to read the content from.
+func (client *AzureClient) GetItemByPath(ctx context.Context, httpClient *http.Client, remotePath string) (*DriveItem, error) {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return nil, err
+	}
+
+	url := itemPathURL(remotePath, "")
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch item metadata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError("failed to fetch item metadata", resp)
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %v", err)
+	}
+
+	return &item, nil
+}
+
+// OpenDownload opens a file's content from its pre-authenticated download URL.
+// The caller must close the returned body.
+func (client *AzureClient) OpenDownload(ctx context.Context, httpClient *http.Client, downloadURL string) (io.ReadCloser, error) {
+	return client.OpenDownloadRange(ctx, httpClient, downloadURL, 0, -1)
+}
+
+// OpenDownloadRange opens length bytes of a file's content starting at offset, or the rest
+// of the file if length is negative. The caller must close the returned body.
+func (client *AzureClient) OpenDownloadRange(ctx context.Context, httpClient *http.Client, downloadURL string, offset, length int64) (io.ReadCloser, error) {
+	partial := offset > 0 || length >= 0
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if partial {
+			end := ""
+			if length >= 0 {
+				end = fmt.Sprint(offset + length - 1)
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", offset, end))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download item: %w", err)
+	}
+
+	switch {
+	case partial && resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+		// The whole file, either requested or because the range was ignored
+	default:
+		defer resp.Body.Close()
+		return nil, newStatusError("failed to download item", resp)
+	}
+
+	return resp.Body, nil
+}
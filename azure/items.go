@@ -0,0 +1,255 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	// graphBaseURL prefixes every Graph API URL
+	graphBaseURL = "https://graph.microsoft.com/"
+	// graphRootURL is the drive root of the signed in user
+	graphRootURL = graphBaseURL + "v1.0/me/drive/root"
+)
+
+// itemPathURL returns the Graph URL of the item at remotePath followed by suffix (e.g. "/children").
+// An empty path is the drive root.
+func itemPathURL(remotePath, suffix string) string {
+	remotePath = strings.Trim(remotePath, "/")
+	if remotePath == "" {
+		return graphRootURL + suffix
+	}
+
+	segments := strings.Split(remotePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	if suffix == "" {
+		return graphRootURL + ":/" + strings.Join(segments, "/")
+	}
+	return graphRootURL + ":/" + strings.Join(segments, "/") + ":" + suffix
+}
+
+// doJSON sends a JSON request to Graph with the client's token and decodes a response
+// with the expected status (0 for any 2xx) into out. op describes the request in errors.
+func (client *AzureClient) doJSON(ctx context.Context, httpClient *http.Client, method, url string, body interface{}, expected int, op string, out interface{}) (*http.Response, error) {
+	if err := client.EnsureTokenValid(ctx, httpClient); err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := client.retryPolicy().do(ctx, httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %s", ErrConflict, responseBody)
+	}
+	if resp.StatusCode != expected && (expected != 0 || resp.StatusCode/100 != 2) {
+		return nil, newStatusError(op, resp)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// GetItemWithChildren retrieves the item at remotePath and, for folders, the first page of
+// its children
+func (client *AzureClient) GetItemWithChildren(ctx context.Context, httpClient *http.Client, remotePath string) (*DriveItem, error) {
+	var item DriveItem
+	if _, err := client.doJSON(ctx, httpClient, "GET", itemPathURL(remotePath, "")+"?$expand=children", nil, http.StatusOK, "failed to fetch item", &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// ChildrenPage is one page of a folder's children
+type ChildrenPage struct {
+	Items     []DriveItem `json:"value"`
+	NextLink  string      `json:"@odata.nextLink,omitempty"` // empty on the last page
+	SkipToken string      `json:"-"`                         // $skiptoken of NextLink
+}
+
+// ListChildren fetches a page of the children of the folder at remotePath, of at most
+// pageSize items (0 leaves the size to Graph). skipToken is the SkipToken of the previous
+// page, or empty for the first page. The URL is always built from remotePath, so a token
+// that came back from a client cannot point the request at another collection.
+func (client *AzureClient) ListChildren(ctx context.Context, httpClient *http.Client, remotePath, skipToken string, pageSize int) (*ChildrenPage, error) {
+	var query []string
+	if pageSize > 0 {
+		query = append(query, fmt.Sprintf("$top=%d", pageSize))
+	}
+	if skipToken != "" {
+		query = append(query, "$skiptoken="+url.QueryEscape(skipToken))
+	}
+	pageURL := itemPathURL(remotePath, "/children")
+	if len(query) > 0 {
+		pageURL += "?" + strings.Join(query, "&")
+	}
+
+	var page ChildrenPage
+	if _, err := client.doJSON(ctx, httpClient, "GET", pageURL, nil, http.StatusOK, "failed to list children", &page); err != nil {
+		return nil, err
+	}
+	if page.NextLink != "" {
+		next, err := url.Parse(page.NextLink)
+		if err == nil {
+			page.SkipToken = next.Query().Get("$skiptoken")
+		}
+		if page.SkipToken == "" {
+			return nil, fmt.Errorf("next page link has no $skiptoken: %s", page.NextLink)
+		}
+	}
+	return &page, nil
+}
+
+// CreateFolder creates the folder name inside the folder at parentPath.
+// conflictBehavior decides what happens if name is taken; ConflictFail returns ErrConflict.
+func (client *AzureClient) CreateFolder(ctx context.Context, httpClient *http.Client, parentPath, name, conflictBehavior string) (*DriveItem, error) {
+	if conflictBehavior == "" {
+		conflictBehavior = ConflictFail
+	}
+	body := map[string]interface{}{
+		"name":                              name,
+		"folder":                            map[string]interface{}{},
+		"@microsoft.graph.conflictBehavior": conflictBehavior,
+	}
+
+	var item DriveItem
+	if _, err := client.doJSON(ctx, httpClient, "POST", itemPathURL(parentPath, "/children"), body, http.StatusCreated, "failed to create folder", &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// MoveItem moves an item into the folder parentID and/or renames it. An empty parentID
+// keeps the item in its folder, an empty name keeps its name.
+func (client *AzureClient) MoveItem(ctx context.Context, httpClient *http.Client, itemID, parentID, name, conflictBehavior string) (*DriveItem, error) {
+	body := map[string]interface{}{}
+	if parentID != "" {
+		body["parentReference"] = ItemReference{ID: parentID}
+	}
+	if name != "" {
+		body["name"] = name
+	}
+
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s", itemID)
+	if conflictBehavior != "" {
+		url += "?@microsoft.graph.conflictBehavior=" + conflictBehavior
+	}
+
+	var item DriveItem
+	if _, err := client.doJSON(ctx, httpClient, "PATCH", url, body, http.StatusOK, "failed to move item", &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// CopyItem starts copying an item into the folder parent under name (empty keeps the name).
+// Graph copies in the background; the returned monitor URL reports progress through GetCopyStatus.
+func (client *AzureClient) CopyItem(ctx context.Context, httpClient *http.Client, itemID string, parent ItemReference, name, conflictBehavior string) (string, error) {
+	body := map[string]interface{}{
+		"parentReference": ItemReference{DriveID: parent.DriveID, ID: parent.ID},
+	}
+	if name != "" {
+		body["name"] = name
+	}
+
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s/copy", itemID)
+	if conflictBehavior != "" {
+		url += "?@microsoft.graph.conflictBehavior=" + conflictBehavior
+	}
+
+	resp, err := client.doJSON(ctx, httpClient, "POST", url, body, http.StatusAccepted, "failed to copy item", nil)
+	if err != nil {
+		return "", err
+	}
+	monitorURL := resp.Header.Get("Location")
+	if monitorURL == "" {
+		return "", fmt.Errorf("copy response has no monitor URL")
+	}
+	return monitorURL, nil
+}
+
+// Copy states reported by the copy monitor
+const (
+	CopyCompleted = "completed"
+	CopyFailed    = "failed"
+)
+
+// CopyStatus is the state of a copy reported by its monitor URL
+type CopyStatus struct {
+	Status             string  `json:"status"` // notStarted, inProgress, completed, failed, ...
+	PercentageComplete float64 `json:"percentageComplete"`
+	ResourceID         string  `json:"resourceId,omitempty"` // ID of the copy
+	Error              *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// GetCopyStatus polls the monitor URL of a copy. The monitor is pre-authenticated, and once
+// the copy completes it redirects to the new item instead of reporting a status.
+func (client *AzureClient) GetCopyStatus(ctx context.Context, httpClient *http.Client, monitorURL string) (*CopyStatus, error) {
+	noRedirect := *httpClient
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.retryPolicy().do(ctx, &noRedirect, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", monitorURL, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch copy status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		var status CopyStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return nil, fmt.Errorf("failed to parse copy status: %v", err)
+		}
+		return &status, nil
+	case http.StatusSeeOther, http.StatusFound:
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid copy location: %v", err)
+		}
+		return &CopyStatus{Status: CopyCompleted, PercentageComplete: 100, ResourceID: path.Base(location.Path)}, nil
+	default:
+		return nil, newStatusError("failed to fetch copy status", resp)
+	}
+}
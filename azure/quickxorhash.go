@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"encoding/base64"
+	"hash"
+)
+
+// QuickXorHash constants, see
+// https://learn.microsoft.com/en-us/onedrive/developer/code-snippets/quickxorhash
+const (
+	// QuickXorHashSize is the size of a QuickXorHash checksum in bytes
+	QuickXorHashSize = 20
+	// QuickXorHashBlockSize is the preferred write size of the hash
+	QuickXorHashBlockSize = 64
+
+	quickXorShift       = 11
+	quickXorWidthInBits = 8 * QuickXorHashSize
+	// Every quickXorDataSize bytes the shift pattern repeats, so input bytes
+	// can be folded into a buffer of that size and shifted once at the end
+	quickXorDataSize = quickXorShift * quickXorWidthInBits
+)
+
+// quickXorHash implements hash.Hash for OneDrive's QuickXorHash
+type quickXorHash struct {
+	data [quickXorDataSize]byte
+	size uint64
+}
+
+// NewQuickXorHash returns a new hash.Hash computing OneDrive's QuickXorHash
+func NewQuickXorHash() hash.Hash {
+	return &quickXorHash{}
+}
+
+// Write folds p into the hash state. It never returns an error.
+func (q *quickXorHash) Write(p []byte) (int, error) {
+	offset := int(q.size % quickXorDataSize)
+	for _, b := range p {
+		q.data[offset] ^= b
+		offset++
+		if offset == quickXorDataSize {
+			offset = 0
+		}
+	}
+	q.size += uint64(len(p))
+	return len(p), nil
+}
+
+// checksum spreads the folded bytes over the 160-bit state and mixes in the length
+func (q *quickXorHash) checksum() [QuickXorHashSize]byte {
+	// One extra byte catches bits shifted past the end, which wrap around to the start
+	var h [QuickXorHashSize + 1]byte
+	for i, b := range q.data {
+		shift := (i * quickXorShift) % quickXorWidthInBits
+		shifted := uint16(b) << (shift % 8)
+		h[shift/8] ^= byte(shifted)
+		h[shift/8+1] ^= byte(shifted >> 8)
+	}
+	h[0] ^= h[QuickXorHashSize]
+
+	// XOR the length into the least significant bits, little endian
+	for i := 0; i < 8; i++ {
+		h[QuickXorHashSize-8+i] ^= byte(q.size >> (8 * i))
+	}
+
+	var sum [QuickXorHashSize]byte
+	copy(sum[:], h[:QuickXorHashSize])
+	return sum
+}
+
+// Sum appends the current checksum to b without changing the hash state
+func (q *quickXorHash) Sum(b []byte) []byte {
+	sum := q.checksum()
+	return append(b, sum[:]...)
+}
+
+// Reset resets the hash to its initial state
+func (q *quickXorHash) Reset() {
+	*q = quickXorHash{}
+}
+
+// Size returns the number of bytes Sum will return
+func (q *quickXorHash) Size() int {
+	return QuickXorHashSize
+}
+
+// BlockSize returns the hash's underlying block size
+func (q *quickXorHash) BlockSize() int {
+	return QuickXorHashBlockSize
+}
+
+// EncodeQuickXorHash returns the base64 form of a checksum, as reported by the Graph API
+func EncodeQuickXorHash(sum []byte) string {
+	return base64.StdEncoding.EncodeToString(sum)
+}
@@ -0,0 +1,78 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// patterned returns n bytes counting up modulo 251, so no stretch of the input repeats
+// on the 1760 byte period of the hash
+func patterned(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+// mustDecode decodes a base64 test input
+func mustDecode(t *testing.T, value string) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatalf("invalid test input %q: %v", value, err)
+	}
+	return data
+}
+
+func TestQuickXorHash(t *testing.T) {
+	// The empty, one and two byte vectors are those of rclone's quickxorhash tests; the
+	// others were computed bit by bit from Microsoft's description of the algorithm
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"empty", nil, "AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{"one byte", mustDecode(t, "Sg=="), "SgAAAAAAAAAAAAAAAQAAAAAAAAA="},
+		{"two bytes", mustDecode(t, "tbQ="), "taAFAAAAAAAAAAAAAgAAAAAAAAA="},
+		{"ascii", []byte("The quick brown fox jumps over the lazy dog"), "bMSlbysmxJL6S75XwfMcQZOpcr4="},
+		{"one past the fold", bytes.Repeat([]byte("a"), quickXorDataSize+1), "nv//////////////Hvn///////8="},
+		{"several folds", patterned(5000), "LFQ9IGHZkfhv6Dsl1lViihpGhPQ="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewQuickXorHash()
+			h.Write(tt.in)
+			if got := EncodeQuickXorHash(h.Sum(nil)); got != tt.want {
+				t.Errorf("QuickXorHash = %s, want %s", got, tt.want)
+			}
+
+			// Writes of any size fold into the same state
+			for _, size := range []int{1, 7, QuickXorHashBlockSize, quickXorDataSize - 1} {
+				h.Reset()
+				for in := tt.in; len(in) > 0; in = in[min(size, len(in)):] {
+					h.Write(in[:min(size, len(in))])
+				}
+				if got := EncodeQuickXorHash(h.Sum(nil)); got != tt.want {
+					t.Errorf("QuickXorHash written %d bytes at a time = %s, want %s", size, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestQuickXorHashSumKeepsState(t *testing.T) {
+	h := NewQuickXorHash()
+	h.Write([]byte("The quick brown fox "))
+	h.Sum(nil)
+	h.Write([]byte("jumps over the lazy dog"))
+	if got, want := EncodeQuickXorHash(h.Sum(nil)), "bMSlbysmxJL6S75XwfMcQZOpcr4="; got != want {
+		t.Errorf("QuickXorHash after Sum = %s, want %s", got, want)
+	}
+	if got := len(h.Sum([]byte("prefix"))); got != len("prefix")+QuickXorHashSize {
+		t.Errorf("Sum appended %d bytes, want %d", got-len("prefix"), QuickXorHashSize)
+	}
+}
@@ -0,0 +1,97 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitedReadSize caps a single read so waits stay short and are spread evenly
+const rateLimitedReadSize = 32 * 1024
+
+// RateLimiter is a token bucket limiting throughput in bytes per second.
+// It is safe for concurrent use; concurrent readers share the bandwidth.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond, with a burst of a quarter second
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	burst := float64(bytesPerSecond) / 4
+	if burst < rateLimitedReadSize {
+		burst = rateLimitedReadSize
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes may pass or ctx is done. Tokens are reserved up front,
+// so concurrent callers are served in the order they asked.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	return sleep(ctx, wait)
+}
+
+// rateLimitedReader passes reads through a set of limiters
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// NewRateLimitedReader returns a reader that throttles r to the slowest of limiters.
+// Nil limiters are ignored; without any limiter r is returned as is.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	active := make([]*RateLimiter, 0, len(limiters))
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: active}
+}
+
+// Read reads at most rateLimitedReadSize bytes and waits for the limiters to admit them
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitedReadSize {
+		p = p[:rateLimitedReadSize]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		for _, limiter := range l.limiters {
+			if waitErr := limiter.WaitN(l.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,444 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how failed Graph requests are retried.
+// Zero fields take their value from DefaultRetryPolicy.
+type RetryPolicy struct {
+	MaxAttempts  int           // total attempts, including the first one
+	InitialDelay time.Duration // delay before the first retry
+	MaxDelay     time.Duration // upper bound for the backoff delay
+	MaxElapsed   time.Duration // give up once this much time has passed since the first attempt
+	Multiplier   float64       // backoff growth factor per attempt
+	Jitter       float64       // randomizes each delay by up to this fraction in either direction
+}
+
+// DefaultRetryPolicy is used when a client or upload does not configure its own policy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 1 * time.Second,
+	MaxDelay:     60 * time.Second,
+	MaxElapsed:   15 * time.Minute,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// withDefaults fills unset fields from DefaultRetryPolicy
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = DefaultRetryPolicy.InitialDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	if p.MaxElapsed <= 0 {
+		p.MaxElapsed = DefaultRetryPolicy.MaxElapsed
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		p.Jitter = DefaultRetryPolicy.Jitter
+	}
+	return p
+}
+
+// backoff returns the delay before retry number attempt (starting at 1)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 - p.Jitter + 2*p.Jitter*rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// begin starts tracking the attempts of one operation
+func (p RetryPolicy) begin() *retryState {
+	return &retryState{
+		policy:  p.withDefaults(),
+		started: time.Now(),
+		attempt: 1,
+	}
+}
+
+// retryState tracks the attempts made for one operation
+type retryState struct {
+	policy  RetryPolicy
+	started time.Time
+	attempt int
+}
+
+// next returns the delay before the next attempt, or false if the policy is exhausted.
+// A Retry-After delay requested by the server takes precedence over a shorter backoff.
+func (s *retryState) next(retryAfter time.Duration) (time.Duration, bool) {
+	if s.attempt >= s.policy.MaxAttempts {
+		return 0, false
+	}
+
+	delay := s.policy.backoff(s.attempt)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	if time.Since(s.started)+delay > s.policy.MaxElapsed {
+		return 0, false
+	}
+
+	s.attempt++
+	return delay, true
+}
+
+// retry calls fn until it succeeds, fails with an error that is not worth retrying,
+// or the policy is exhausted. onRetry, if set, is called before each retry.
+func (p RetryPolicy) retry(ctx context.Context, fn func() error, onRetry func()) error {
+	state := p.begin()
+	for {
+		err := fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+
+		delay, ok := state.next(retryAfter(err))
+		if !ok {
+			return fmt.Errorf("giving up after %d attempts: %w", state.attempt, err)
+		}
+
+		log.Printf("Attempt %d/%d failed: %v", state.attempt-1, state.policy.MaxAttempts, err)
+		log.Printf("Retrying in %v...", delay.Round(time.Millisecond))
+		if onRetry != nil {
+			onRetry()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// do sends the request built by newRequest, retrying network errors and transient
+// status codes. The response of the last attempt is returned for the caller to check.
+func (p RetryPolicy) do(ctx context.Context, httpClient *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	state := p.begin()
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := httpClient.Do(req)
+		if ctx.Err() != nil {
+			// Cancelled requests are not retried
+			return resp, err
+		}
+		var wait time.Duration
+		if err == nil {
+			if !retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			wait = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+
+		delay, ok := state.next(wait)
+		if !ok {
+			return resp, err
+		}
+
+		if err != nil {
+			log.Printf("%s %s failed: %v", req.Method, req.URL.Path, err)
+		} else {
+			log.Printf("%s %s returned status %d", req.Method, req.URL.Path, resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Printf("Retrying in %v (attempt %d/%d)...", delay.Round(time.Millisecond), state.attempt, state.policy.MaxAttempts)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for d, returning early with the context's error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// StatusError is returned when the Graph API answers with an unexpected status code
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+// Error formats the error like the other Graph errors of this package
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s, status: %d, response: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// newStatusError reads the response body into a StatusError
+func newStatusError(op string, resp *http.Response) *StatusError {
+	responseBody, _ := io.ReadAll(resp.Body)
+	return &StatusError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Body:       string(responseBody),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// retryableStatus reports whether a request that failed with code may succeed when repeated
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryable reports whether an operation that failed with err is worth repeating.
+// Network errors are retried; Graph errors only for transient status codes.
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrConflict) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.StatusCode)
+	}
+	return true
+}
+
+// retryAfter returns the delay requested by the server for err, if any
+func retryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// ErrUploadSessionNotFound is returned when an upload session has expired or was already completed
+var ErrUploadSessionNotFound = errors.New("upload session not found")
+
+// UploadSession is the state of an upload session as reported by OneDrive
+type UploadSession struct {
+	ExpirationDateTime time.Time `json:"expirationDateTime"`
+	NextExpectedRanges []string  `json:"nextExpectedRanges"`
+}
+
+// byteRange is a parsed entry of nextExpectedRanges; End is -1 for an open range
+type byteRange struct {
+	Start, End int64
+}
+
+// expectedRanges parses the session's nextExpectedRanges, e.g. "0-1023" or "2048-"
+func (session *UploadSession) expectedRanges() ([]byteRange, error) {
+	ranges := make([]byteRange, 0, len(session.NextExpectedRanges))
+	for _, value := range session.NextExpectedRanges {
+		startStr, endStr, _ := strings.Cut(value, "-")
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected range %q", value)
+		}
+		end := int64(-1)
+		if endStr != "" {
+			if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid expected range %q", value)
+			}
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
+
+// resumeOffset returns the first byte of start-end OneDrive still expects, or done if it
+// already has the whole range. With sequential set, missing bytes before start are an
+// error, since a streaming upload can no longer resend them.
+func (session *UploadSession) resumeOffset(start, end int64, sequential bool) (offset int64, done bool, err error) {
+	ranges, err := session.expectedRanges()
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, r := range ranges {
+		if r.End != -1 && r.End < start {
+			if sequential {
+				return 0, false, fmt.Errorf("upload session is missing bytes %d-%d, which were already sent", r.Start, r.End)
+			}
+			continue
+		}
+		if r.Start > end {
+			break
+		}
+		if r.Start < start {
+			if sequential {
+				return 0, false, fmt.Errorf("upload session is missing bytes from %d, which were already sent", r.Start)
+			}
+			return start, false, nil
+		}
+		return r.Start, false, nil
+	}
+	return 0, true, nil
+}
+
+// getUploadSession queries which byte ranges an upload session still expects
+func (client *AzureClient) getUploadSession(ctx context.Context, httpClient *http.Client, uploadURL string, policy RetryPolicy) (*UploadSession, error) {
+	resp, err := policy.do(ctx, httpClient, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", uploadURL, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upload session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUploadSessionNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError("failed to query upload session", resp)
+	}
+
+	var session UploadSession
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, fmt.Errorf("failed to parse upload session: %v", err)
+	}
+	return &session, nil
+}
+
+// GetUploadSession returns the state of an upload session, including the byte ranges it still expects
+func (client *AzureClient) GetUploadSession(ctx context.Context, httpClient *http.Client, uploadURL string) (*UploadSession, error) {
+	return client.getUploadSession(ctx, httpClient, uploadURL, client.retryPolicy())
+}
+
+// sendChunk uploads chunk, holding bytes start-end of a file of totalSize bytes, to an upload session.
+// Failed attempts are retried according to policy. Before each retry the session is asked which
+// bytes it still expects, so only the part of the chunk OneDrive is missing is sent again.
+// With sequential set, all bytes before start must already have been received.
+func (client *AzureClient) sendChunk(ctx context.Context, httpClient *http.Client, uploadURL string, chunk []byte, start, end, totalSize int64, policy RetryPolicy, sequential bool, onRetry func()) (*DriveItem, error) {
+	state := policy.begin()
+	offset := start
+	for {
+		item, err := client.uploadChunk(ctx, httpClient, uploadURL, chunk[offset-start:], offset, end, totalSize)
+		if err == nil {
+			return item, nil
+		}
+		if !isRetryableChunkError(err) {
+			return nil, err
+		}
+
+		delay, ok := state.next(retryAfter(err))
+		if !ok {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", state.attempt, err)
+		}
+
+		log.Printf("Error uploading chunk %d-%d: %v", offset, end, err)
+		log.Printf("Retrying chunk upload in %v (attempt %d/%d)...", delay.Round(time.Millisecond), state.attempt, state.policy.MaxAttempts)
+		if onRetry != nil {
+			onRetry()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+
+		// Resume from what OneDrive actually has. The query gets a single attempt,
+		// a failed one just means the chunk is resent from the current offset.
+		session, err := client.getUploadSession(ctx, httpClient, uploadURL, RetryPolicy{MaxAttempts: 1})
+		if errors.Is(err, ErrUploadSessionNotFound) && end == totalSize-1 {
+			// The session is gone after the last byte was committed; the caller looks the item up
+			log.Printf("Upload session completed while retrying the final chunk")
+			return nil, nil
+		}
+		if err != nil {
+			log.Printf("Resending chunk %d-%d, session state unavailable: %v", offset, end, err)
+			continue
+		}
+
+		next, done, err := session.resumeOffset(start, end, sequential)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			log.Printf("Chunk %d-%d was already received", start, end)
+			return nil, nil
+		}
+		if next != offset {
+			log.Printf("Resuming chunk %d-%d from byte %d", start, end, next)
+		}
+		offset = next
+	}
+}
+
+// isRetryableChunkError reports whether a failed chunk upload should be resumed.
+// 416 means OneDrive already has some of the range, which the session state resolves.
+func isRetryableChunkError(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return true
+	}
+	return isRetryable(err)
+}
+
+// retryPolicy returns the client's retry policy
+func (client *AzureClient) retryPolicy() RetryPolicy {
+	return client.RetryPolicy.withDefaults()
+}
+
+// retryPolicy returns the policy for an upload: the client's policy, with
+// MaxRetries and RetryDelay taking precedence when set. MaxRetries counts the
+// retries after the first attempt.
+func (params UploadParams) retryPolicy(client *AzureClient) RetryPolicy {
+	policy := client.retryPolicy()
+	if params.MaxRetries > 0 {
+		policy.MaxAttempts = params.MaxRetries + 1
+	}
+	if params.RetryDelay > 0 {
+		policy.InitialDelay = params.RetryDelay
+		if policy.MaxDelay < policy.InitialDelay {
+			policy.MaxDelay = policy.InitialDelay
+		}
+	}
+	return policy
+}
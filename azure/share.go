@@ -0,0 +1,97 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Sharing link types
+const (
+	LinkView  = "view"
+	LinkEdit  = "edit"
+	LinkEmbed = "embed" // OneDrive personal only
+)
+
+// Sharing link scopes
+const (
+	ScopeAnonymous    = "anonymous"
+	ScopeOrganization = "organization" // OneDrive for Business only
+)
+
+// ShareLinkOptions describes a sharing link to create
+type ShareLinkOptions struct {
+	Type               string     `json:"type"`
+	Scope              string     `json:"scope,omitempty"` // defaults to the drive's policy
+	ExpirationDateTime *time.Time `json:"expirationDateTime,omitempty"`
+	Password           string     `json:"password,omitempty"` // OneDrive personal only
+}
+
+// SharingLink is the link of a sharing permission
+type SharingLink struct {
+	Type    string `json:"type"`
+	Scope   string `json:"scope"`
+	WebURL  string `json:"webUrl"`
+	WebHTML string `json:"webHtml,omitempty"` // embed links
+}
+
+// Identity is a user, group or application a permission is granted to
+type Identity struct {
+	ID          string `json:"id,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	Email       string `json:"email,omitempty"`
+}
+
+// IdentitySet holds the identities of a permission grant
+type IdentitySet struct {
+	User        *Identity `json:"user,omitempty"`
+	Group       *Identity `json:"group,omitempty"`
+	Application *Identity `json:"application,omitempty"`
+}
+
+// Permission is a sharing permission on a drive item: a sharing link or a direct grant
+type Permission struct {
+	ID                 string         `json:"id"`
+	Roles              []string       `json:"roles"`
+	Link               *SharingLink   `json:"link,omitempty"`
+	ExpirationDateTime *time.Time     `json:"expirationDateTime,omitempty"`
+	HasPassword        bool           `json:"hasPassword,omitempty"`
+	GrantedTo          *IdentitySet   `json:"grantedToV2,omitempty"`
+	GrantedToList      []IdentitySet  `json:"grantedToIdentitiesV2,omitempty"`
+	InheritedFrom      *ItemReference `json:"inheritedFrom,omitempty"`
+}
+
+// CreateLink creates a sharing link to an item, or returns the existing link of the same
+// type and scope
+func (client *AzureClient) CreateLink(ctx context.Context, httpClient *http.Client, itemID string, opts ShareLinkOptions) (*Permission, error) {
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s/createLink", itemID)
+
+	var permission Permission
+	if _, err := client.doJSON(ctx, httpClient, "POST", url, opts, 0, "failed to create sharing link", &permission); err != nil {
+		return nil, err
+	}
+	return &permission, nil
+}
+
+// ListPermissions lists the sharing permissions of an item
+func (client *AzureClient) ListPermissions(ctx context.Context, httpClient *http.Client, itemID string) ([]Permission, error) {
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s/permissions", itemID)
+
+	var page struct {
+		Value []Permission `json:"value"`
+	}
+	if _, err := client.doJSON(ctx, httpClient, "GET", url, nil, http.StatusOK, "failed to list permissions", &page); err != nil {
+		return nil, err
+	}
+	return page.Value, nil
+}
+
+// DeletePermission revokes a sharing permission of an item
+func (client *AzureClient) DeletePermission(ctx context.Context, httpClient *http.Client, itemID, permissionID string) error {
+	endpoint := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s/permissions/%s", itemID, url.PathEscape(permissionID))
+
+	_, err := client.doJSON(ctx, httpClient, "DELETE", endpoint, nil, http.StatusNoContent, "failed to delete permission", nil)
+	return err
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetEnvWithDefault returns the value of the environment variable key, or defaultValue if it is unset
+func GetEnvWithDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// GetEnvDurationWithDefault parses the environment variable key as seconds or a duration string
+func GetEnvDurationWithDefault(key string, defaultValue time.Duration) time.Duration {
+	strValue := GetEnvWithDefault(key, "")
+	if strValue == "" {
+		return defaultValue
+	}
+
+	// Try to parse as seconds
+	if seconds, err := strconv.Atoi(strValue); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	// Try to parse as duration string
+	if duration, err := time.ParseDuration(strValue); err == nil {
+		return duration
+	}
+
+	return defaultValue
+}
+
+// GetEnvIntWithDefault parses the environment variable key as an integer
+func GetEnvIntWithDefault(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(GetEnvWithDefault(key, "")); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// ParseByteSize parses a size such as "512K", "10M" or "1.5GiB" into bytes.
+// Suffixes are binary (K = 1024) and a plain number is taken as bytes.
+func ParseByteSize(value string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(value))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			str = str[:n-1]
+		}
+	}
+
+	// ParseFloat also accepts Inf, NaN and exponents, so check the result fits in an int64
+	number, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || number < 0 || math.IsNaN(number) || number >= float64(math.MaxInt64/multiplier) {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// GetEnvSizeWithDefault parses the environment variable key with ParseByteSize
+func GetEnvSizeWithDefault(key string, defaultValue int64) int64 {
+	if size, err := ParseByteSize(GetEnvWithDefault(key, "")); err == nil {
+		return size
+	}
+	return defaultValue
+}
+
+// GetEnvMap parses the environment variable key as comma separated name=value pairs
+func GetEnvMap(key string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(GetEnvWithDefault(key, ""), ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if name = strings.TrimSpace(name); ok && name != "" {
+			values[name] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,46 @@
+package config
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		{value: "512K", want: 512 << 10},
+		{value: "10M", want: 10 << 20},
+		{value: "10mb", want: 10 << 20},
+		{value: "1.5GiB", want: 3 << 29},
+		{value: "2T", want: 2 << 40},
+		{value: " 64 K ", want: 64 << 10},
+		{value: "", wantErr: true},
+		{value: "M", wantErr: true},
+		{value: "-1M", wantErr: true},
+		{value: "10X", wantErr: true},
+		{value: "ten", wantErr: true},
+		{value: "inf", wantErr: true},
+		{value: "+Inf", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "1e30", wantErr: true},
+		{value: "9223372036854775807", wantErr: true},
+		{value: "8388608T", wantErr: true},
+		{value: "0x1p70", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q) = %d, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -6,11 +6,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/ksauraj/ksau-oned-api/api"
+	"github.com/ksauraj/ksau-oned-api/config"
 )
 
 const (
@@ -19,43 +19,23 @@ const (
 	defaultIdleTimeout  = 120 * time.Second
 )
 
-func getEnvWithDefault(key string, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-func getEnvDurationWithDefault(key string, defaultValue time.Duration) time.Duration {
-	strValue := getEnvWithDefault(key, "")
-	if strValue == "" {
-		return defaultValue
-	}
-
-	// Try to parse as seconds
-	if seconds, err := strconv.Atoi(strValue); err == nil {
-		return time.Duration(seconds) * time.Second
-	}
-
-	// Try to parse as duration string
-	if duration, err := time.ParseDuration(strValue); err == nil {
-		return duration
-	}
-
-	return defaultValue
-}
-
 type maxBytesHandler struct {
 	h http.Handler
 	n int64
 }
 
 func (h *maxBytesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.ContentLength > h.n {
+	n := h.n
+	// Split uploads are stored as several OneDrive items and may be larger. They must ask
+	// for split mode with the header, since the body is capped before its fields are read.
+	if r.Header.Get("X-Split-Size") != "" {
+		n = max(n, api.MaxSplitFileSize())
+	}
+	if r.ContentLength > n {
 		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, h.n)
+	r.Body = http.MaxBytesReader(w, r.Body, n)
 	h.h.ServeHTTP(w, r)
 }
 
@@ -73,6 +53,52 @@ func main() {
 		api.Handler(w, r)
 	})
 
+	// Server-side upload of a file fetched from another server
+	mux.HandleFunc("/upload/url", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received URL upload request: %s %s", r.Method, r.URL.Path)
+		api.URLUploadHandler(w, r)
+	})
+
+	// Remote-to-remote copies and moves
+	mux.HandleFunc("/transfer", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received transfer request: %s %s", r.Method, r.URL.Path)
+		api.TransferHandler(w, r)
+	})
+
+	// Resumable uploads via the tus protocol
+	mux.HandleFunc("/tus/", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received tus request: %s %s", r.Method, r.URL.Path)
+		api.TusHandler(w, r)
+	})
+
+	mux.HandleFunc("/tus/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received tus request: %s %s", r.Method, r.URL.Path)
+		api.TusHandler(w, r)
+	})
+
+	// Live upload progress as Server-Sent Events
+	mux.HandleFunc("/uploads/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received upload events request: %s %s", r.Method, r.URL.Path)
+		api.UploadEventsHandler(w, r)
+	})
+
+	// Cancel an active upload or job
+	mux.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received upload cancel request: %s %s", r.Method, r.URL.Path)
+		api.UploadCancelHandler(w, r)
+	})
+
+	// Asynchronous upload job status
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received jobs request: %s %s", r.Method, r.URL.Path)
+		api.JobsHandler(w, r)
+	})
+
+	mux.HandleFunc("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received job status request: %s %s", r.Method, r.URL.Path)
+		api.JobsHandler(w, r)
+	})
+
 	// Token generation endpoint
 	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Received token request: %s %s", r.Method, r.URL.Path)
@@ -95,13 +121,86 @@ func main() {
 		api.QuotaHandler(w, r)
 	})
 
+	// Downloads through Graph, independent of the remotes' indexes
+	mux.HandleFunc("/download/{remote}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received download request: %s %s", r.Method, r.URL.Path)
+		api.DownloadHandler(w, r)
+	})
+
+	// Whole folders as zip or tar.gz archives
+	mux.HandleFunc("/archive/{remote}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received archive request: %s %s", r.Method, r.URL.Path)
+		api.ArchiveHandler(w, r)
+	})
+
+	mux.HandleFunc("/archive/{remote}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received archive request: %s %s", r.Method, r.URL.Path)
+		api.ArchiveHandler(w, r)
+	})
+
+	// Reassembled downloads of split uploads
+	mux.HandleFunc("/split/{remote}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received split download request: %s %s", r.Method, r.URL.Path)
+		api.SplitDownloadHandler(w, r)
+	})
+
+	// Drive item management: list, stat, mkdir, copy, move, rename and delete
+	mux.HandleFunc("/files/{remote}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received files request: %s %s", r.Method, r.URL.Path)
+		api.FilesHandler(w, r)
+	})
+
+	mux.HandleFunc("/files/{remote}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received files request: %s %s", r.Method, r.URL.Path)
+		api.FilesHandler(w, r)
+	})
+
+	// Paginated, sorted and filtered folder listings
+	mux.HandleFunc("/list/{remote}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received list request: %s %s", r.Method, r.URL.Path)
+		api.ListHandler(w, r)
+	})
+
+	mux.HandleFunc("/list/{remote}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received list request: %s %s", r.Method, r.URL.Path)
+		api.ListHandler(w, r)
+	})
+
+	// OneDrive sharing links and permissions
+	mux.HandleFunc("/share/{remote}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received share request: %s %s", r.Method, r.URL.Path)
+		api.ShareHandler(w, r)
+	})
+
+	// Pending expirations of time-limited uploads
+	mux.HandleFunc("/admin/expirations", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received expirations request: %s %s", r.Method, r.URL.Path)
+		api.AdminExpirationsHandler(w, r)
+	})
+
+	mux.HandleFunc("/admin/expirations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received expiration request: %s %s", r.Method, r.URL.Path)
+		api.AdminExpirationsHandler(w, r)
+	})
+
+	mux.HandleFunc("/admin/expirations/{id}/extend", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received expiration extend request: %s %s", r.Method, r.URL.Path)
+		api.AdminExpirationsHandler(w, r)
+	})
+
+	// Delete time-limited uploads once they expire, and discard abandoned tus uploads
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	api.StartExpiryJanitor(janitorCtx)
+	api.StartTusJanitor(janitorCtx)
+
 	// Get server timeouts from environment variables
-	readTimeout := getEnvDurationWithDefault("SERVER_READ_TIMEOUT", defaultReadTimeout)
-	writeTimeout := getEnvDurationWithDefault("SERVER_WRITE_TIMEOUT", defaultWriteTimeout)
-	idleTimeout := getEnvDurationWithDefault("SERVER_IDLE_TIMEOUT", defaultIdleTimeout)
+	readTimeout := config.GetEnvDurationWithDefault("SERVER_READ_TIMEOUT", defaultReadTimeout)
+	writeTimeout := config.GetEnvDurationWithDefault("SERVER_WRITE_TIMEOUT", defaultWriteTimeout)
+	idleTimeout := config.GetEnvDurationWithDefault("SERVER_IDLE_TIMEOUT", defaultIdleTimeout)
 
 	// Create server with timeouts
-	addr := getEnvWithDefault("SERVER_ADDR", "0.0.0.0:8080")
+	addr := config.GetEnvWithDefault("SERVER_ADDR", "0.0.0.0:8080")
 
 	// Set maximum request size to 5GB
 	maxRequestSize := int64(5 * 1024 * 1024 * 1024)